@@ -2,9 +2,14 @@ module github.com/cptaffe/mailrules
 
 go 1.21.1
 
-require github.com/emersion/go-imap v1.2.1
+require (
+	github.com/emersion/go-imap v1.2.1
+	golang.org/x/net v0.17.0
+	golang.org/x/text v0.13.0
+)
 
 require (
+	github.com/emersion/go-message v0.15.0 // indirect
 	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead // indirect
-	golang.org/x/text v0.8.0 // indirect
+	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
 )
@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cptaffe/mailrules/parse"
 	"github.com/cptaffe/mailrules/rules"
@@ -14,128 +19,366 @@ import (
 	"github.com/emersion/go-imap/client"
 )
 
-const mailbox = "INBOX"
-
 var (
-	hostFlag     = flag.String("host", "", "IMAP host:port")
-	usernameFlag = flag.String("username", "", "IMAP login username")
-	passwordFlag = flag.String("password", "", "IMAP login password")
-	rulesFlag    = flag.String("rules", "", "rules file")
+	hostFlag            = flag.String("host", "", "IMAP host:port")
+	usernameFlag        = flag.String("username", "", "IMAP login username")
+	passwordFlag        = flag.String("password", "", "IMAP login password")
+	rulesFlag           = flag.String("rules", "", "rules file")
+	stateFlag           = flag.String("state", "", "directory in which to persist state across restarts")
+	smtpHostFlag        = flag.String("smtp-host", "", "SMTP submission host:port, for rules which send mail")
+	smtpUsernameFlag    = flag.String("smtp-username", "", "SMTP login username, if different to the IMAP username")
+	smtpPasswordFlag    = flag.String("smtp-password", "", "SMTP login password, if different to the IMAP password")
+	smtpFromFlag        = flag.String("smtp-from", "", "sender of mail sent by rules, if different to the SMTP username")
+	classifyTimeoutFlag = flag.Duration("classify-timeout", rules.DefaultClassifyTimeout, "timeout of each request to a classifier")
+	pipeTimeoutFlag     = flag.Duration("pipe-timeout", rules.DefaultPipeTimeout, "timeout of each command run by a pipe rule")
+	pipeConcurrencyFlag = flag.Int("pipe-concurrency", rules.DefaultPipeConcurrency, "how many commands pipe rules run at once")
 )
 
 func main() {
 	flag.Parse()
 
+	env := &rules.Environment{
+		Store:           rules.NewStore(*stateFlag),
+		HTTPClient:      http.DefaultClient,
+		ClassifyTimeout: *classifyTimeoutFlag,
+		PipeTimeout:     *pipeTimeoutFlag,
+		PipeConcurrency: *pipeConcurrencyFlag,
+	}
+	if *smtpHostFlag != "" {
+		env.SMTP = &rules.SMTPRelay{
+			Addr:     *smtpHostFlag,
+			Username: or(*smtpUsernameFlag, *usernameFlag),
+			Password: or(*smtpPasswordFlag, *passwordFlag),
+		}
+		env.SMTP.From = or(*smtpFromFlag, env.SMTP.Username)
+	}
+
 	log.Println("Parsing rules...")
-	f, err := os.Open(*rulesFlag)
+	blocks, err := parse.ParseFile(*rulesFlag, env)
 	if err != nil {
 		log.Fatal(err)
 	}
-	rules, err := parse.Parse(f)
-	if err != nil {
-		log.Fatal(err)
+
+	log.Println("Rules:")
+	var mailboxes []string
+	byMailbox := make(map[string][]*rules.Block)
+	for _, block := range blocks {
+		if block.Schedule != nil {
+			log.Printf("In mailbox '%s' %s:", block.Mailbox, block.Schedule)
+		} else {
+			log.Printf("In mailbox '%s':", block.Mailbox)
+		}
+		for _, rule := range block.Rules {
+			log.Printf("* %s", rule)
+		}
+		if _, ok := byMailbox[block.Mailbox]; !ok {
+			mailboxes = append(mailboxes, block.Mailbox)
+		}
+		byMailbox[block.Mailbox] = append(byMailbox[block.Mailbox], block)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Each mailbox is watched over its own connection, as IDLE only reports
+	// changes to the selected mailbox.
+	watchers := len(mailboxes)
+	errs := make(chan error, watchers+1)
+	for _, mailbox := range mailboxes {
+		go func(mailbox string) {
+			errs <- watchMailbox(ctx, env, mailbox, byMailbox[mailbox])
+		}(mailbox)
+	}
+	if env.Sent != nil && env.Sent.Used() {
+		watchers++
+		go func() {
+			errs <- watchSent(ctx, env)
+		}()
+	}
+	for i := 0; i < watchers; i++ {
+		if err := <-errs; err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// or returns the first non-empty string.
+func or(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func login() (*client.Client, error) {
 	log.Println("Connecting to server...")
 
 	c, err := client.DialTLS(*hostFlag, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("connect to `%s`: %w", *hostFlag, err)
 	}
 	log.Println("Connected")
 
-	// Don't forget to logout
-	defer c.Logout()
-
-	// Login
 	if err := c.Login(*usernameFlag, *passwordFlag); err != nil {
-		log.Fatal(err)
+		c.Logout()
+		return nil, fmt.Errorf("login: %w", err)
 	}
 	log.Println("Logged in")
 
-	log.Println("Rules:")
-	for _, rule := range rules {
-		log.Printf("* %s", rule)
+	// Capabilities may change after login, so ask again rather than relying
+	// on those advertised in the greeting
+	caps, err := c.Capability()
+	if err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("capability: %w", err)
+	}
+	var names []string
+	for name := range caps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("Server supports %s", strings.Join(names, " "))
+	return c, nil
+}
+
+// watchMailbox applies each block's rules whenever the mailbox changes or,
+// for scheduled blocks, whenever their schedule next comes due.
+func watchMailbox(ctx context.Context, env *rules.Environment, mailbox string, blocks []*rules.Block) error {
+	c, err := login()
+	if err != nil {
+		return err
+	}
+
+	// Don't forget to logout
+	defer c.Logout()
+
+	var all []rules.Rule
+	for _, block := range blocks {
+		all = append(all, block.Rules...)
+	}
+	if err := rules.CheckCapabilities(c, all); err != nil {
+		return fmt.Errorf("rules in mailbox `%s` are unsupported by the server: %w", mailbox, err)
 	}
 
-	// Select INBOX
 	mbox, err := c.Select(mailbox, false)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("select mailbox `%s`: %w", mailbox, err)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
+	// The last run of each scheduled block is recorded, so that a restart
+	// neither skips nor repeats it
+	runs, err := env.Store.Ledger("schedule")
+	if err != nil {
+		return err
+	}
+	var onChange []rules.Rule
+	next := make(map[*rules.Block]time.Time) // next run of each scheduled block
+	now := time.Now()
+	for _, block := range blocks {
+		if block.Schedule == nil {
+			onChange = append(onChange, block.Rules...)
+		} else {
+			last, _ := runs.Time(scheduleKey(mailbox, block))
+			next[block] = rules.Resume(block.Schedule, last, now)
+		}
+	}
+
+	pending := onChange
+	var timer *time.Timer
 	for {
-		processMailbox(ctx, c, mbox, rules)
+		if !now.IsZero() {
+			for block, at := range next {
+				if !at.After(now) {
+					log.Printf("Running scheduled rules in %s %s", mailbox, block.Schedule)
+					pending = append(pending, block.Rules...)
+					next[block] = block.Schedule.Next(now)
+					runs.Renew(scheduleKey(mailbox, block), "")
+				}
+			}
+		}
+		if len(pending) > 0 {
+			if err := processMailbox(ctx, c, mbox, pending); err != nil {
+				return err
+			}
+			if err := env.Store.Flush(); err != nil {
+				log.Println("Save state:", err)
+			}
+			pending = nil
+		}
 
-		log.Println("Listening...")
+		log.Printf("Listening to %s...", mailbox)
 
-		// Create a channel to receive mailbox updates
-		updates := make(chan client.Update)
-		c.Updates = updates
+		// Wake for the next scheduled block
+		var wake <-chan time.Time
+		if timer != nil {
+			timer.Stop()
+		}
+		if due, ok := earliest(next); ok {
+			timer = time.NewTimer(time.Until(due))
+			wake = timer.C
+		}
 
-		// Start idling
-		stop := make(chan struct{})
-		done := make(chan error, 1)
-		go func() {
-			done <- c.Idle(stop, nil)
-		}()
+		var changed bool
+		changed, now, err = idleUntil(ctx, c, mailbox, wake)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if changed && len(onChange) > 0 {
+			log.Printf("Saw change to %s", mailbox)
+			pending = onChange
+		}
+	}
+}
 
-		// Listen for updates
-		for {
-			select {
-			case update := <-updates:
-				switch update := update.(type) {
-				case *client.MailboxUpdate:
-					if update.Mailbox.Name != mailbox {
-						break
-					}
-					log.Println("Saw change to Inbox")
-
-					// stop idling
-					close(stop)
-					close(updates)
-					c.Updates = nil
-				}
-			case err := <-done:
-				if err != nil {
-					log.Fatal(err)
+// scheduleKey identifies a scheduled block in the ledger of their runs.
+func scheduleKey(mailbox string, block *rules.Block) string {
+	return fmt.Sprintf("%s %s", mailbox, block.Schedule)
+}
+
+// idleUntil idles until the selected mailbox changes, wake fires or ctx is
+// done. It reports whether the mailbox changed and when wake fired, if it did.
+func idleUntil(ctx context.Context, c *client.Client, mailbox string, wake <-chan time.Time) (changed bool, woke time.Time, err error) {
+	// Create a channel to receive mailbox updates
+	updates := make(chan client.Update)
+	c.Updates = updates
+
+	// Start idling
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stop, nil)
+	}()
+	stopIdle := func() {
+		if c.Updates == nil {
+			return // already stopping
+		}
+		close(stop)
+		c.Updates = nil
+	}
+
+	// Listen for updates until idling stops, draining those sent meanwhile
+	for {
+		select {
+		case update := <-updates:
+			switch update := update.(type) {
+			case *client.MailboxUpdate:
+				if update.Mailbox.Name == mailbox {
+					changed = true
+					stopIdle()
 				}
-				goto Process
-			case <-ctx.Done():
-				return
 			}
+		case woke = <-wake:
+			wake = nil
+			stopIdle()
+		case err := <-done:
+			if err != nil {
+				return false, time.Time{}, fmt.Errorf("idle in mailbox `%s`: %w", mailbox, err)
+			}
+			return changed, woke, nil
+		case <-ctx.Done():
+			return false, time.Time{}, nil
 		}
-	Process:
 	}
 }
 
-func processMailbox(ctx context.Context, c *client.Client, mbox *imap.MailboxStatus, rules []rules.Rule) {
+// watchSent keeps the index of sent mail up to date as mail is sent.
+func watchSent(ctx context.Context, env *rules.Environment) error {
+	c, err := login()
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	mailbox, err := rules.SpecialUseMailbox(c, imap.SentAttr)
+	if err != nil {
+		return fmt.Errorf("find sent mailbox: %w", err)
+	}
+	for {
+		mbox, err := c.Select(mailbox, true)
+		if err != nil {
+			return fmt.Errorf("select mailbox `%s`: %w", mailbox, err)
+		}
+		log.Printf("Reading %s...", mailbox)
+		if err := env.Sent.Refresh(c, mbox); err != nil {
+			return err
+		}
+		if err := env.Store.Flush(); err != nil {
+			log.Println("Save state:", err)
+		}
+
+		log.Printf("Listening to %s...", mailbox)
+		if _, _, err := idleUntil(ctx, c, mailbox, nil); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// earliest returns the earliest of the scheduled times.
+func earliest(times map[*rules.Block]time.Time) (time.Time, bool) {
+	var first time.Time
+	for _, t := range times {
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+	}
+	return first, !first.IsZero()
+}
+
+func processMailbox(ctx context.Context, c *client.Client, mbox *imap.MailboxStatus, rs []rules.Rule) error {
 	seqset := new(imap.SeqSet)
 	seqset.AddRange(1, 0)
 	messages := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
 	go func() {
-		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+		done <- c.UidFetch(seqset, rules.FetchItems(rs), messages)
 	}()
 
-	log.Println("Reading Inbox...")
+	// Messages which rules must inspect the body of are held back until
+	// the bodies have been fetched in a second pass
+	log.Printf("Reading %s...", mbox.Name)
+	var held []*imap.Message
 	for msg := range messages {
-		for _, rule := range rules {
+		rules.Observe(rs, msg)
+		if rules.NeedsBody(rs, msg) {
+			held = append(held, msg)
+			continue
+		}
+		for _, rule := range rs {
 			rule.Message(msg)
 		}
 	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("fetch messages in mailbox `%s`: %w", mbox.Name, err)
+	}
+	if len(held) > 0 {
+		log.Printf("Reading the bodies of %d messages in %s...", len(held), mbox.Name)
+		if err := rules.LoadBodies(ctx, c, rs, held); err != nil {
+			return fmt.Errorf("fetch message bodies in mailbox `%s`: %w", mbox.Name, err)
+		}
+		for _, msg := range held {
+			for _, rule := range rs {
+				if rules.Undecided(rule, msg) {
+					continue // left for the next pass
+				}
+				rule.Message(msg)
+			}
+		}
+	}
 
 	// TODO: Multiple rules can match the same message and perform incompatible actions
-	for _, rule := range rules {
+	for _, rule := range rs {
 		err := rule.Action(ctx, c)
 		if err != nil {
 			log.Println("Apply rule:", err)
 		}
 	}
-
-	if err := <-done; err != nil {
-		log.Fatal(err)
-	}
+	return nil
 }
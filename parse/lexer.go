@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"unicode/utf8"
 
 	"github.com/cptaffe/mailrules/rules"
@@ -29,6 +32,8 @@ const (
 	TokenComment
 	TokenIdentifier
 	TokenNumber
+	TokenDuration
+	TokenNetwork
 	TokenQuote
 
 	// Operators
@@ -68,6 +73,31 @@ const (
 	TokenFlag
 	TokenUnflag
 	TokenStream
+	TokenInclude
+	TokenIn
+	TokenMailbox
+	TokenEvery
+	TokenAt
+	TokenIdentity
+	TokenMe
+	TokenOnly
+	TokenTrusted
+	TokenWithin
+	TokenSuspicious
+	TokenProtect
+	TokenPer
+	TokenIs
+	TokenUnsubscribe
+	TokenClassify
+	TokenCopy
+	TokenTrash
+	TokenDelete
+	TokenForward
+	TokenRedirect
+	TokenVacation
+	TokenPipeAction
+	TokenWebhook
+	TokenSave
 )
 
 var tokenNames = [...]string{
@@ -76,6 +106,8 @@ var tokenNames = [...]string{
 	TokenComment:      "COMMENT",
 	TokenIdentifier:   "IDENTIFIER",
 	TokenNumber:       "NUMBER",
+	TokenDuration:     "DURATION",
+	TokenNetwork:      "NETWORK",
 	TokenQuote:        "QUOTE",
 	TokenPlus:         "PLUS",
 	TokenMinus:        "MINUS",
@@ -111,18 +143,68 @@ var tokenNames = [...]string{
 	TokenFlag:         "FLAG",
 	TokenUnflag:       "UNFLAG",
 	TokenStream:       "STREAM",
+	TokenInclude:      "INCLUDE",
+	TokenIn:           "IN",
+	TokenMailbox:      "MAILBOX",
+	TokenEvery:        "EVERY",
+	TokenAt:           "AT",
+	TokenIdentity:     "IDENTITY",
+	TokenMe:           "ME",
+	TokenOnly:         "ONLY",
+	TokenTrusted:      "TRUSTED",
+	TokenWithin:       "WITHIN",
+	TokenSuspicious:   "SUSPICIOUS",
+	TokenProtect:      "PROTECT",
+	TokenPer:          "PER",
+	TokenIs:           "IS",
+	TokenUnsubscribe:  "UNSUBSCRIBE",
+	TokenClassify:     "CLASSIFY",
+	TokenCopy:         "COPY",
+	TokenTrash:        "TRASH",
+	TokenDelete:       "DELETE",
+	TokenForward:      "FORWARD",
+	TokenRedirect:     "REDIRECT",
+	TokenVacation:     "VACATION",
+	TokenPipeAction:   "PIPE_ACTION",
+	TokenWebhook:      "WEBHOOK",
+	TokenSave:         "SAVE",
 }
 
 var reservedWords = map[string]TokenType{
-	"if":     TokenIf,
-	"move":   TokenMove,
-	"and":    TokenAnd,
-	"or":     TokenOr,
-	"not":    TokenNot,
-	"then":   TokenThen,
-	"flag":   TokenFlag,
-	"unflag": TokenUnflag,
-	"stream": TokenStream,
+	"if":          TokenIf,
+	"move":        TokenMove,
+	"and":         TokenAnd,
+	"or":          TokenOr,
+	"not":         TokenNot,
+	"then":        TokenThen,
+	"flag":        TokenFlag,
+	"unflag":      TokenUnflag,
+	"stream":      TokenStream,
+	"include":     TokenInclude,
+	"in":          TokenIn,
+	"mailbox":     TokenMailbox,
+	"every":       TokenEvery,
+	"at":          TokenAt,
+	"identity":    TokenIdentity,
+	"me":          TokenMe,
+	"only":        TokenOnly,
+	"trusted":     TokenTrusted,
+	"within":      TokenWithin,
+	"suspicious":  TokenSuspicious,
+	"protect":     TokenProtect,
+	"per":         TokenPer,
+	"is":          TokenIs,
+	"unsubscribe": TokenUnsubscribe,
+	"classify":    TokenClassify,
+	"copy":        TokenCopy,
+	"trash":       TokenTrash,
+	"delete":      TokenDelete,
+	"forward":     TokenForward,
+	"redirect":    TokenRedirect,
+	"vacation":    TokenVacation,
+	"pipe":        TokenPipeAction,
+	"webhook":     TokenWebhook,
+	"save":        TokenSave,
 }
 
 func (tok Token) String() string {
@@ -266,7 +348,8 @@ func (lex *Lexer) skipNontokens() {
 
 func (lex *Lexer) scanIdentifier() Token {
 	startpos := lex.rpos
-	for isAlpha(lex.r) || isDigit(lex.r) {
+	// Fields may be dotted, as in list.id, or hyphenated, as in reply-to
+	for isAlpha(lex.r) || isDigit(lex.r) || (lex.r == '.' || lex.r == '-') && isAlpha(lex.peekNextByte()) {
 		lex.next()
 	}
 	val := string(lex.buf[startpos:lex.rpos])
@@ -281,6 +364,25 @@ func (lex *Lexer) scanNumber() Token {
 	for isDigit(lex.r) {
 		lex.next()
 	}
+	if lex.r == '.' && isDigit(lex.peekNextByte()) {
+		// An IP address or network, such as 203.0.113.0/24, or a decimal
+		// number, such as 0.5
+		for isDigit(lex.r) || lex.r == '.' || lex.r == '/' {
+			lex.next()
+		}
+		text := string(lex.buf[startpos:lex.rpos])
+		if strings.Count(text, ".") == 1 && !strings.Contains(text, "/") {
+			return Token{TokenNumber, text, startpos}
+		}
+		return Token{TokenNetwork, text, startpos}
+	}
+	if isAlpha(lex.r) {
+		// A number with a unit, such as 90d
+		for isAlpha(lex.r) {
+			lex.next()
+		}
+		return Token{TokenDuration, string(lex.buf[startpos:lex.rpos]), startpos}
+	}
 	return Token{TokenNumber, string(lex.buf[startpos:lex.rpos]), startpos}
 }
 
@@ -327,13 +429,32 @@ func isDigit(r rune) bool {
 	return '0' <= r && r <= '9'
 }
 
-func Parse(input io.Reader) ([]rules.Rule, error) {
+func Parse(input io.Reader, env *rules.Environment) ([]*rules.Block, error) {
 	buf, err := io.ReadAll(input)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	lex := NewLexer(buf)
-	parse := NewParser(lex)
+	parse := NewParser(lex, env)
+	return parse.Parse()
+}
+
+// ParseFile parses the rules in the named file. Files included by it are
+// resolved relative to its directory.
+func ParseFile(path string, env *rules.Environment) ([]*rules.Block, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lex := NewLexer(buf)
+	parse := NewParser(lex, env)
+	parse.file = path
+	parse.includes = []string{abs}
 	return parse.Parse()
 }
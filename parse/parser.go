@@ -3,34 +3,97 @@ package parse
 //go:generate goyacc -o rules.go -xe rules.examples -pool rules.y
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cptaffe/mailrules/rules"
 )
 
 var tokenNumbers = [...]int{
-	TokenIdentifier: IDENTIFIER,
-	TokenQuote:      QUOTE,
-	TokenEquals:     EQUALS,
-	TokenTilde:      TILDE,
-	TokenSemi:       SEMICOLON,
-	TokenIf:         IF,
-	TokenMove:       MOVE,
-	TokenAnd:        AND,
-	TokenOr:         OR,
-	TokenNot:        NOT,
-	TokenThen:       THEN,
-	TokenFlag:       FLAG,
-	TokenUnflag:     UNFLAG,
-	TokenStream:     STREAM,
-	TokenLeftParen:  LPAREN,
-	TokenRightParen: RPAREN,
+	TokenIdentifier:   IDENTIFIER,
+	TokenQuote:        QUOTE,
+	TokenEquals:       EQUALS,
+	TokenTilde:        TILDE,
+	TokenSemi:         SEMICOLON,
+	TokenIf:           IF,
+	TokenMove:         MOVE,
+	TokenAnd:          AND,
+	TokenOr:           OR,
+	TokenNot:          NOT,
+	TokenThen:         THEN,
+	TokenFlag:         FLAG,
+	TokenUnflag:       UNFLAG,
+	TokenStream:       STREAM,
+	TokenLeftParen:    LPAREN,
+	TokenRightParen:   RPAREN,
+	TokenInclude:      INCLUDE,
+	TokenIn:           IN,
+	TokenMailbox:      MAILBOX,
+	TokenLeftBrace:    LBRACE,
+	TokenRightBrace:   RBRACE,
+	TokenLeftBracket:  LBRACKET,
+	TokenRightBracket: RBRACKET,
+	TokenLeftAngle:    LT,
+	TokenRightAngle:   GT,
+	TokenDuration:     DURATION,
+	TokenEvery:        EVERY,
+	TokenAt:           AT,
+	TokenIdentity:     IDENTITY,
+	TokenMe:           ME,
+	TokenOnly:         ONLY,
+	TokenComma:        COMMA,
+	TokenNumber:       NUMBER,
+	TokenNetwork:      NETWORK,
+	TokenTrusted:      TRUSTED,
+	TokenWithin:       WITHIN,
+	TokenSuspicious:   SUSPICIOUS,
+	TokenProtect:      PROTECT,
+	TokenPer:          PER,
+	TokenIs:           IS,
+	TokenUnsubscribe:  UNSUBSCRIBE,
+	TokenClassify:     CLASSIFY,
+	TokenCopy:         COPY,
+	TokenTrash:        TRASH,
+	TokenDelete:       DELETE,
+	TokenForward:      FORWARD,
+	TokenRedirect:     REDIRECT,
+	TokenVacation:     VACATION,
+	TokenPipeAction:   PIPE,
+	TokenWebhook:      WEBHOOK,
+	TokenSave:         SAVE,
 }
 
 type Parser struct {
 	lexer  *Lexer
 	last   Token
-	result []rules.Rule
+	result []*rules.Block
 	err    error
+
+	// Name of the file being parsed, empty for anonymous input.
+	file string
+	// Absolute paths of the files currently being parsed, outermost first.
+	includes []string
+	// Declarations shared with included files.
+	decls *declarations
+	env   *rules.Environment
+}
+
+// declarations are made by a file or any file it includes and apply to every
+// rule.
+type declarations struct {
+	identities rules.Identities
+	// Whether any rule refers to the identities.
+	usesIdentities bool
+	received       rules.ReceivedChain
+	protected      rules.ProtectedDomains
+	// Histories of rate predicates, by field.
+	rates map[string]*rules.RateHistory
+	// Classifiers, by content and url, so that predicates using the same
+	// classifier share its results.
+	classifiers map[string]*rules.Classifier
 }
 
 func (p *Parser) Lex(lval *yySymType) int {
@@ -42,7 +105,7 @@ func (p *Parser) Lex(lval *yySymType) int {
 		case TokenEOF:
 			return -1
 		case TokenError:
-			p.err = fmt.Errorf("lexing error: %s", tok.Value)
+			p.err = fmt.Errorf("%s: lexing error", p.position(tok.Position))
 			return -1
 		case TokenComment:
 			continue // skip
@@ -54,10 +117,206 @@ func (p *Parser) Lex(lval *yySymType) int {
 }
 
 func (p *Parser) Error(err string) {
-	p.err = fmt.Errorf("%s near position %d", err, p.last.Position)
+	p.err = fmt.Errorf("%s: %s", p.position(p.last.Position), err)
+}
+
+// position formats the byte offset pos as file:line:column.
+func (p *Parser) position(pos int) string {
+	line, col := 1, 1
+	for _, b := range p.lexer.buf[:pos] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	if p.file == "" {
+		return fmt.Sprintf("%d:%d", line, col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.file, line, col)
+}
+
+// resolve resolves path relative to the directory of the file being parsed.
+func (p *Parser) resolve(path string) string {
+	if filepath.IsAbs(path) || p.file == "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(p.file), path)
 }
 
-func (p *Parser) Parse() ([]rules.Rule, error) {
+// fieldPredicate constructs the predicate matching predicate against field.
+func (p *Parser) fieldPredicate(field string, predicate rules.StringPredicate) (rules.Predicate, error) {
+	switch {
+	case strings.HasPrefix(field, "received."):
+		return rules.NewReceivedPredicate(field, predicate, &p.decls.received)
+	case field == "link" || strings.HasPrefix(field, "link."):
+		return rules.NewLinkPredicate(field, predicate)
+	}
+	return rules.NewFieldPredicate(field, predicate)
+}
+
+// ratePredicate constructs the predicate comparing the number of messages
+// with the same value of field, such as from.rate, received within window.
+func (p *Parser) ratePredicate(field string, comparison rules.Comparison, count string, window string) (rules.Predicate, error) {
+	name, ok := strings.CutSuffix(field, ".rate")
+	if !ok {
+		return nil, fmt.Errorf("unknown rate field '%s'", field)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("malformed number '%s': %w", count, err)
+	}
+	d, err := parseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	history, ok := p.decls.rates[name]
+	if !ok {
+		history, err = rules.NewRateHistory(name, p.env.Store)
+		if err != nil {
+			return nil, err
+		}
+		p.decls.rates[name] = history
+	}
+	return rules.NewRatePredicate(history, comparison, n, d), nil
+}
+
+// isPredicate constructs the predicate for a property of field, such as
+// from is correspondent, or of the message if field is empty, such as is bulk.
+func (p *Parser) isPredicate(field string, property string) (rules.Predicate, error) {
+	switch property {
+	case "correspondent":
+		if field == "" {
+			return nil, fmt.Errorf("correspondent is a property of an address, as in 'from is correspondent'")
+		}
+		return rules.NewCorrespondentPredicate(field, p.sent())
+	case "bulk", "reply":
+		if field != "" {
+			return nil, fmt.Errorf("%s is a property of the message, as in 'is %s'", property, property)
+		}
+		if property == "reply" {
+			return &rules.ReplyPredicate{}, nil
+		}
+		return &rules.BulkPredicate{}, nil
+	default:
+		return nil, fmt.Errorf("unknown property '%s', expected one of [correspondent, bulk, reply]", property)
+	}
+}
+
+// threadPredicate constructs the predicate matching the subject of the
+// thread, written in thread with subject ~ "...".
+func (p *Parser) threadPredicate(thread string, with string, field string, predicate rules.StringPredicate) (rules.Predicate, error) {
+	if thread != "thread" || with != "with" || field != "subject" {
+		return nil, fmt.Errorf("unknown predicate 'in %s %s %s', expected 'in thread with subject'", thread, with, field)
+	}
+	return &rules.ThreadPredicate{Predicate: predicate}, nil
+}
+
+// sent returns the index of sent mail, creating it for the first rule to use
+// it.
+func (p *Parser) sent() *rules.SentIndex {
+	if p.env.Sent == nil {
+		p.env.Sent = rules.NewSentIndex(p.env.Store)
+	}
+	return p.env.Sent
+}
+
+// classifier returns the classifier posting content to url.
+func (p *Parser) classifier(content string, url string) (*rules.Classifier, error) {
+	key := content + " " + url
+	if classifier, ok := p.decls.classifiers[key]; ok {
+		return classifier, nil
+	}
+	classifier, err := rules.NewClassifier(content, url, p.env)
+	if err != nil {
+		return nil, err
+	}
+	p.decls.classifiers[key] = classifier
+	return classifier, nil
+}
+
+// vacation constructs the vacation rule from its options, given as pairs of
+// names and values.
+func (p *Parser) vacation(pairs []string) (*rules.VacationRule, error) {
+	options := make(map[string]string)
+	for i := 0; i < len(pairs); i += 2 {
+		if _, ok := options[pairs[i]]; ok {
+			return nil, fmt.Errorf("vacation option '%s' is given more than once", pairs[i])
+		}
+		options[pairs[i]] = pairs[i+1]
+	}
+	p.decls.usesIdentities = true
+	return rules.NewVacationRule(nil, options, &p.decls.identities, p.env)
+}
+
+// pipe constructs the rule piping messages to command, which is resolved
+// relative to the directory of the file being parsed unless it is a bare name
+// looked up in PATH.
+func (p *Parser) pipe(content string, command string, args []string) (*rules.PipeRule, error) {
+	if strings.ContainsRune(command, filepath.Separator) {
+		command = p.resolve(command)
+	}
+	return rules.NewPipeRule(nil, content, command, args, p.env)
+}
+
+// include parses every file matching pattern, which may be a glob and is
+// resolved relative to the directory of the file being parsed.
+func (p *Parser) include(pattern string) ([]*rules.Block, error) {
+	pattern = p.resolve(pattern)
+	paths := []string{pattern}
+	if strings.ContainsAny(pattern, "*?[\\") {
+		var err error
+		paths, err = filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include `%s`: %w", p.position(p.last.Position), pattern, err)
+		}
+	}
+
+	var included []*rules.Block
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include `%s`: %w", p.position(p.last.Position), path, err)
+		}
+		for i, f := range p.includes {
+			if f == abs {
+				cycle := strings.Join(append(p.includes[i:len(p.includes):len(p.includes)], abs), " -> ")
+				return nil, fmt.Errorf("%s: include cycle: %s", p.position(p.last.Position), cycle)
+			}
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include: %w", p.position(p.last.Position), err)
+		}
+		parser := NewParser(NewLexer(buf), p.env)
+		parser.file = path
+		parser.includes = append(p.includes[:len(p.includes):len(p.includes)], abs)
+		parser.decls = p.decls
+		blocks, err := parser.parse()
+		if err != nil {
+			return nil, err
+		}
+		included = append(included, blocks...)
+	}
+	return included, nil
+}
+
+// Parse parses the input into blocks of rules, one for each mailbox.
+func (p *Parser) Parse() ([]*rules.Block, error) {
+	blocks, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.decls.usesIdentities && len(p.decls.identities.Patterns) == 0 {
+		return nil, fmt.Errorf("rules refer to 'me' or reply on vacation but no identity is declared")
+	}
+	return mergeBlocks(scope(blocks, rules.DefaultMailbox)), nil
+}
+
+// parse parses the input, leaving rules outside of any `in mailbox` block
+// unscoped so that they can be scoped by an including file.
+func (p *Parser) parse() ([]*rules.Block, error) {
 	yyParse(p)
 	if p.err != nil {
 		return nil, p.err
@@ -65,6 +324,73 @@ func (p *Parser) Parse() ([]rules.Rule, error) {
 	return p.result, nil
 }
 
-func NewParser(lexer *Lexer) *Parser {
-	return &Parser{lexer: lexer}
+// scope assigns the unscoped blocks to mailbox.
+func scope(blocks []*rules.Block, mailbox string) []*rules.Block {
+	for _, block := range blocks {
+		if block.Mailbox == "" {
+			block.Mailbox = mailbox
+		}
+	}
+	return blocks
+}
+
+// schedule assigns the unscheduled blocks to schedule.
+func schedule(blocks []*rules.Block, schedule rules.Schedule) []*rules.Block {
+	for _, block := range blocks {
+		if block.Schedule == nil {
+			block.Schedule = schedule
+		}
+	}
+	return blocks
+}
+
+// mergeBlocks combines blocks for the same mailbox and schedule, preserving
+// the order of their rules.
+func mergeBlocks(blocks []*rules.Block) []*rules.Block {
+	type key struct {
+		mailbox  string
+		schedule rules.Schedule
+	}
+	var merged []*rules.Block
+	byKey := make(map[key]*rules.Block)
+	for _, block := range blocks {
+		k := key{block.Mailbox, block.Schedule}
+		if m, ok := byKey[k]; ok {
+			m.Rules = append(m.Rules, block.Rules...)
+			continue
+		}
+		m := &rules.Block{Mailbox: block.Mailbox, Schedule: block.Schedule, Rules: block.Rules}
+		byKey[k] = m
+		merged = append(merged, m)
+	}
+	return merged
+}
+
+// parseDuration parses a number with a unit, one of s, m, h, d or w.
+func parseDuration(s string) (time.Duration, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !isDigit(r) })
+	n, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, fmt.Errorf("malformed duration '%s': %w", s, err)
+	}
+	units := map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	unit, ok := units[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit '%s' in duration '%s', expected one of [s, m, h, d, w]", s[i:], s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func NewParser(lexer *Lexer, env *rules.Environment) *Parser {
+	decls := &declarations{
+		rates:       make(map[string]*rules.RateHistory),
+		classifiers: make(map[string]*rules.Classifier),
+	}
+	return &Parser{lexer: lexer, decls: decls, env: env}
 }
@@ -0,0 +1,214 @@
+package parse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cptaffe/mailrules/rules"
+)
+
+// testEnvironment is an environment with state kept in memory and a relay
+// which is never used.
+func testEnvironment() *rules.Environment {
+	return &rules.Environment{
+		Store: rules.NewStore(""),
+		SMTP:  &rules.SMTPRelay{Addr: "localhost:25", From: "me@example.com"},
+	}
+}
+
+// formatBlocks lists the rules of each block, one per line, prefixed by the
+// mailbox they apply to.
+func formatBlocks(blocks []*rules.Block) string {
+	var b strings.Builder
+	for _, block := range blocks {
+		for _, rule := range block.Rules {
+			fmt.Fprintf(&b, "%s: %s\n", block.Mailbox, rule)
+		}
+	}
+	return b.String()
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+		err  string
+	}{
+		{
+			name: "forward",
+			src:  `if subject = "Invoice" then forward "assistant@example.com";`,
+			want: "INBOX: if subject = \"Invoice\" then forward \"assistant@example.com\"\n",
+		},
+		{
+			name: "forward to a named address",
+			src:  `if subject = "Invoice" then forward inline "Assistant <assistant@example.com>";`,
+			want: "INBOX: if subject = \"Invoice\" then forward inline \"assistant@example.com\"\n",
+		},
+		{
+			name: "forward to a malformed address",
+			src:  `if subject = "Invoice" then forward "assistant";`,
+			err:  "malformed address 'assistant'",
+		},
+		{
+			name: "redirect to a named address",
+			src:  `if subject = "Invoice" then redirect "Archive <archive@example.net>";`,
+			want: "INBOX: if subject = \"Invoice\" then redirect \"archive@example.net\"\n",
+		},
+		{
+			name: "received ip in a network",
+			src:  `if received.ip in 10.0.0.0/8 then move "Internal";`,
+			want: "INBOX: if received.ip in 10.0.0.0/8 then move \"Internal\"\n",
+		},
+		{
+			name: "from in a network",
+			src:  `if from in 10.0.0.0/8 then move "Internal";`,
+			err:  "field 'from' can't be in a network",
+		},
+		{
+			name: "received host in a network",
+			src:  `if received.host in 10.0.0.0/8 then move "Internal";`,
+			err:  "field 'received.host' can't be in a network",
+		},
+		{
+			name: "delete confirm",
+			src:  `if age > 52w then delete confirm;`,
+			want: "INBOX: if age > 52w then delete confirm\n",
+		},
+		{
+			name: "delete",
+			src:  `if age > 52w then delete;`,
+			err:  "write 'delete confirm' to confirm",
+		},
+		{
+			name: "delete without confirm",
+			src:  `if age > 52w then delete now;`,
+			err:  "unexpected 'now', expected 'delete confirm'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks, err := NewParser(NewLexer([]byte(tt.src)), testEnvironment()).Parse()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatBlocks(blocks); got != tt.want {
+				t.Errorf("got rules\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInclude(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string // by path relative to the directory, parsed from main.rules
+		want  string
+		err   string // with $DIR the directory
+	}{
+		{
+			name: "relative to the including file",
+			files: map[string]string{
+				"main.rules":             `include "common/marketing.rules";`,
+				"common/marketing.rules": `include "sale.rules";`,
+				"common/sale.rules":      `if subject = "Sale" then move "Sales";`,
+			},
+			want: "INBOX: if subject = \"Sale\" then move \"Sales\"\n",
+		},
+		{
+			name: "glob",
+			files: map[string]string{
+				"main.rules":      `include "rules.d/*.rules";`,
+				"rules.d/b.rules": `if subject = "B" then move "Sales";`,
+				"rules.d/a.rules": `if subject = "A" then move "Sales";`,
+				"rules.d/c.txt":   `if subject = "C" then move "Sales";`,
+			},
+			want: "INBOX: if subject = \"A\" then move \"Sales\"\nINBOX: if subject = \"B\" then move \"Sales\"\n",
+		},
+		{
+			name: "glob matching nothing",
+			files: map[string]string{
+				"main.rules": `include "rules.d/*.rules"; if subject = "A" then move "Sales";`,
+			},
+			want: "INBOX: if subject = \"A\" then move \"Sales\"\n",
+		},
+		{
+			name: "in a mailbox",
+			files: map[string]string{
+				"main.rules":      `in mailbox "Marketing" { include "marketing.rules"; }`,
+				"marketing.rules": `if subject = "Sale" then move "Sales";`,
+			},
+			want: "Marketing: if subject = \"Sale\" then move \"Sales\"\n",
+		},
+		{
+			name: "same file twice",
+			files: map[string]string{
+				"main.rules":   `include "a.rules"; include "b.rules";`,
+				"a.rules":      `include "common.rules";`,
+				"b.rules":      `include "common.rules";`,
+				"common.rules": `if subject = "Sale" then move "Sales";`,
+			},
+			want: "INBOX: if subject = \"Sale\" then move \"Sales\"\nINBOX: if subject = \"Sale\" then move \"Sales\"\n",
+		},
+		{
+			name: "itself",
+			files: map[string]string{
+				"main.rules": `include "main.rules";`,
+			},
+			err: "include cycle: $DIR/main.rules -> $DIR/main.rules",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.rules": `include "a.rules";`,
+				"a.rules":    `include "b.rules";`,
+				"b.rules":    `include "*.rules";`,
+			},
+			err: "include cycle: $DIR/a.rules -> $DIR/b.rules -> $DIR/a.rules",
+		},
+		{
+			name: "missing",
+			files: map[string]string{
+				"main.rules": `include "missing.rules";`,
+			},
+			err: "include: open $DIR/missing.rules",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, src := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			blocks, err := ParseFile(filepath.Join(dir, "main.rules"), testEnvironment())
+			if tt.err != "" {
+				want := strings.ReplaceAll(tt.err, "$DIR", dir)
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Fatalf("got error %v, want %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatBlocks(blocks); got != tt.want {
+				t.Errorf("got rules\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,7 +4,9 @@ package parse
 import (
     "fmt"
     "regexp"
+    "strconv"
     "strings"
+    "time"
 
     "github.com/cptaffe/mailrules/rules"
 )
@@ -13,41 +15,208 @@ import (
 %union{
     Value      string
     Values     []string
-    Rules      []rules.Rule
+    Blocks     []*rules.Block
     Rule       rules.Rule
     MoveRule   *rules.MoveRule
+    CopyRule   *rules.CopyRule
+    TrashRule  *rules.TrashRule
+    DeleteRule *rules.DeleteRule
+    ForwardRule *rules.ForwardRule
+    RedirectRule *rules.RedirectRule
+    VacationRule *rules.VacationRule
+    PipeRule   *rules.PipeRule
+    WebhookRule *rules.WebhookRule
+    SaveRule   *rules.SaveRule
     FlagRule   *rules.FlagRule
     UnflagRule *rules.UnflagRule
     StreamRule *rules.StreamRule
+    UnsubscribeRule *rules.UnsubscribeRule
     Predicate  rules.Predicate
+    Classifier *rules.Classifier
 }
 
 %left AND OR
 %right NOT
 
-%type <Rules> rules
+%type <Blocks> statements statement block
 %type <Rule> rule
 %type <MoveRule> move
+%type <CopyRule> copy
+%type <TrashRule> trash
+%type <DeleteRule> delete
+%type <ForwardRule> forward
+%type <RedirectRule> redirect
+%type <VacationRule> vacation
+%type <PipeRule> pipe
+%type <WebhookRule> webhook
+%type <SaveRule> save
 %type <FlagRule> flag
 %type <UnflagRule> unflag
 %type <StreamRule> stream
+%type <UnsubscribeRule> unsubscribe
 %type <Predicate> condition comparison
-%type <Values> list
+%type <Classifier> classifier
+%type <Values> list options option args
 %type <Value> string
 
-%token <Value> IDENTIFIER QUOTE TILDE EQUALS THEN SEMICOLON IF MOVE FLAG UNFLAG STREAM LPAREN RPAREN
+%token <Value> IDENTIFIER QUOTE NUMBER DURATION NETWORK TILDE EQUALS LT GT THEN SEMICOLON IF MOVE FLAG UNFLAG STREAM INCLUDE IN MAILBOX EVERY AT IDENTITY ME ONLY TRUSTED WITHIN SUSPICIOUS PROTECT PER IS UNSUBSCRIBE CLASSIFY COPY TRASH DELETE FORWARD REDIRECT VACATION PIPE WEBHOOK SAVE COMMA LPAREN RPAREN LBRACE RBRACE LBRACKET RBRACKET
 
 %%
-start: rules
+start: statements
     { yylex.(*Parser).result = $1 }
 
-rules: rule SEMICOLON
-    { $$ = append($$, $1) }
-    | rules rule SEMICOLON
-    { $$ = append($$, $2) }
+statements: statement
+    { $$ = $1 }
+    | statements statement
+    { $$ = append($1, $2...) }
+
+statement: rule SEMICOLON
+    { $$ = []*rules.Block{{Rules: []rules.Rule{$1}}} }
+    | INCLUDE string SEMICOLON
+    {
+        included, err := yylex.(*Parser).include($2)
+        if err != nil {
+            yylex.(*Parser).err = err
+            return -1
+        }
+        $$ = included
+    }
+    | IDENTITY list SEMICOLON
+    {
+        if err := yylex.(*Parser).decls.identities.Add($2...); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = nil
+    }
+    | PROTECT list SEMICOLON
+    {
+        yylex.(*Parser).decls.protected.Add($2...)
+        $$ = nil
+    }
+    | TRUSTED IDENTIFIER NUMBER SEMICOLON
+    {
+        if $2 != "hops" {
+            yylex.Error(fmt.Sprintf("unknown trusted setting '%s', expected hops", $2))
+            return -1
+        }
+        hops, err := strconv.Atoi($3)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed number of trusted hops '%s': %v", $3, err))
+            return -1
+        }
+        yylex.(*Parser).decls.received.TrustedHops = hops
+        $$ = nil
+    }
+    | IN MAILBOX string block
+    { $$ = scope($4, $3) }
+    | EVERY DURATION block
+    {
+        d, err := parseDuration($2)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        if d <= 0 {
+            yylex.Error(fmt.Sprintf("interval '%s' must be positive", $2))
+            return -1
+        }
+        $$ = schedule($3, rules.IntervalSchedule(d))
+    }
+    | AT string block
+    {
+        cron, err := rules.NewCronSchedule($2)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        if cron.Next(time.Now()).IsZero() {
+            yylex.Error(fmt.Sprintf("cron expression `%s` never matches", $2))
+            return -1
+        }
+        $$ = schedule($3, cron)
+    }
+
+block: LBRACE statements RBRACE
+    { $$ = $2 }
+    | LBRACE RBRACE
+    { $$ = nil }
 
 rule: IF condition THEN move
     {
+        if err := $4.Mailbox.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN copy
+    {
+        if err := $4.Mailbox.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN trash
+    {
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN delete
+    {
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN forward
+    {
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN redirect
+    {
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN vacation
+    {
+        if err := $4.Subject.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        if err := $4.Body.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN pipe
+    {
+        if err := $4.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN webhook
+    {
+        if err := $4.URL.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN save
+    {
+        if err := $4.Path.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
         $4.Predicate = $2
         $$ = $4
     }
@@ -62,6 +231,15 @@ rule: IF condition THEN move
         $$ = $4
     }
     | IF condition THEN stream
+    {
+        if err := $4.URL.Check($2); err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $4.Predicate = $2
+        $$ = $4
+    }
+    | IF condition THEN unsubscribe
     {
         $4.Predicate = $2
         $$ = $4
@@ -86,7 +264,7 @@ comparison:
             yylex.Error(fmt.Sprintf("malformed regex '%s' in predicate: %v", $3, err))
             return -1
         }
-        $$, err = rules.NewFieldPredicate($1, rexp)
+        $$, err = yylex.(*Parser).fieldPredicate($1, rexp)
         if err != nil {
             yylex.Error(err.Error())
             return -1
@@ -94,16 +272,426 @@ comparison:
     }
     | IDENTIFIER EQUALS string
     {
-        predicate, err := rules.NewFieldPredicate($1, rules.StringEqualsPredicate($3))
+        predicate, err := yylex.(*Parser).fieldPredicate($1, rules.StringEqualsPredicate($3))
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = predicate
+    }
+    | IN IDENTIFIER IDENTIFIER IDENTIFIER TILDE string
+    {
+        rexp, err := regexp.Compile($6)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed regex '%s' in predicate: %v", $6, err))
+            return -1
+        }
+        $$, err = yylex.(*Parser).threadPredicate($2, $3, $4, rexp)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+    | IN IDENTIFIER IDENTIFIER IDENTIFIER EQUALS string
+    {
+        predicate, err := yylex.(*Parser).threadPredicate($2, $3, $4, rules.StringEqualsPredicate($6))
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = predicate
+    }
+    | IDENTIFIER WITHIN string
+    {
+        predicate, err := yylex.(*Parser).fieldPredicate($1, rules.DomainPredicate($3))
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = predicate
+    }
+    | IDENTIFIER IN IDENTIFIER string
+    {
+        list, err := rules.NewAddressList($3, yylex.(*Parser).resolve($4))
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$, err = yylex.(*Parser).fieldPredicate($1, list)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+    | IDENTIFIER IN NETWORK
+    {
+        if $1 != "received.ip" {
+            yylex.Error(fmt.Sprintf("field '%s' can't be in a network, only received.ip can", $1))
+            return -1
+        }
+        network, err := rules.NewNetworkPredicate($3)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$, err = yylex.(*Parser).fieldPredicate($1, network)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+    | IDENTIFIER IN string
+    {
+        network, err := rules.NewNetworkPredicate($3)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$, err = yylex.(*Parser).fieldPredicate($1, network)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+    | IDENTIFIER ME
+    {
+        predicate, err := rules.NewIdentityPredicate($1, false, &yylex.(*Parser).decls.identities)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        yylex.(*Parser).decls.usesIdentities = true
+        $$ = predicate
+    }
+    | IDENTIFIER IS IDENTIFIER
+    {
+        predicate, err := yylex.(*Parser).isPredicate($1, $3)
         if err != nil {
             yylex.Error(err.Error())
             return -1
         }
         $$ = predicate
     }
+    | IS IDENTIFIER
+    {
+        predicate, err := yylex.(*Parser).isPredicate("", $2)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = predicate
+    }
+    | IDENTIFIER IDENTIFIER ME
+    {
+        if $1 != "replies" || $2 != "to" {
+            yylex.Error(fmt.Sprintf("unknown predicate '%s %s me', expected 'replies to me'", $1, $2))
+            return -1
+        }
+        $$ = rules.NewRepliesToMePredicate(yylex.(*Parser).sent())
+    }
+    | classifier EQUALS string
+    { $$ = &rules.ClassifyPredicate{Classifier: $1, Label: rules.StringEqualsPredicate($3)} }
+    | classifier TILDE string
+    {
+        rexp, err := regexp.Compile($3)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed regex '%s' in predicate: %v", $3, err))
+            return -1
+        }
+        $$ = &rules.ClassifyPredicate{Classifier: $1, Label: rexp}
+    }
+    | classifier GT NUMBER
+    {
+        threshold, err := strconv.ParseFloat($3, 64)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed score '%s': %v", $3, err))
+            return -1
+        }
+        $$ = &rules.ClassifyPredicate{Classifier: $1, Comparison: rules.GreaterThan, Threshold: threshold}
+    }
+    | classifier LT NUMBER
+    {
+        threshold, err := strconv.ParseFloat($3, 64)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed score '%s': %v", $3, err))
+            return -1
+        }
+        $$ = &rules.ClassifyPredicate{Classifier: $1, Comparison: rules.LessThan, Threshold: threshold}
+    }
+    | SUSPICIOUS IDENTIFIER
+    {
+        predicate, err := rules.NewSuspiciousPredicate($2, &yylex.(*Parser).decls.protected)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = predicate
+    }
+    | ONLY IDENTIFIER ME
+    {
+        predicate, err := rules.NewIdentityPredicate($2, true, &yylex.(*Parser).decls.identities)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        yylex.(*Parser).decls.usesIdentities = true
+        $$ = predicate
+    }
+    | IDENTIFIER GT NUMBER
+    {
+        n, err := strconv.Atoi($3)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed number '%s': %v", $3, err))
+            return -1
+        }
+        $$, err = rules.NewCountPredicate($1, rules.GreaterThan, n)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+    | IDENTIFIER LT NUMBER
+    {
+        n, err := strconv.Atoi($3)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed number '%s': %v", $3, err))
+            return -1
+        }
+        $$, err = rules.NewCountPredicate($1, rules.LessThan, n)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+    | IDENTIFIER GT NUMBER PER DURATION
+    {
+        predicate, err := yylex.(*Parser).ratePredicate($1, rules.GreaterThan, $3, $5)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = predicate
+    }
+    | IDENTIFIER LT NUMBER PER DURATION
+    {
+        predicate, err := yylex.(*Parser).ratePredicate($1, rules.LessThan, $3, $5)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = predicate
+    }
+    | IDENTIFIER GT DURATION
+    {
+        d, err := parseDuration($3)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$, err = rules.NewDurationPredicate($1, rules.GreaterThan, d)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+    | IDENTIFIER LT DURATION
+    {
+        d, err := parseDuration($3)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$, err = rules.NewDurationPredicate($1, rules.LessThan, d)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+    }
+
+classifier: CLASSIFY string
+    {
+        classifier, err := yylex.(*Parser).classifier(string(rules.StreamContentRFC822), $2)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = classifier
+    }
+    | CLASSIFY IDENTIFIER string
+    {
+        classifier, err := yylex.(*Parser).classifier($2, $3)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = classifier
+    }
 
 move: MOVE string
-    { $$ = rules.NewMoveRule(nil, $2) }
+    {
+        rule, err := rules.NewMoveRule(nil, $2)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+copy: COPY string
+    {
+        rule, err := rules.NewCopyRule(nil, $2, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+trash: TRASH
+    { $$ = rules.NewTrashRule(nil) }
+
+delete: DELETE IDENTIFIER
+    {
+        if $2 != "confirm" {
+            yylex.Error(fmt.Sprintf("unexpected '%s', expected 'delete confirm'", $2))
+            return -1
+        }
+        $$ = rules.NewDeleteRule(nil)
+    }
+    | DELETE
+    {
+        yylex.Error("delete permanently removes messages, write 'delete confirm' to confirm")
+        return -1
+    }
+
+forward: FORWARD string
+    {
+        rule, err := rules.NewForwardRule(nil, "attached", $2, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+    | FORWARD IDENTIFIER string
+    {
+        rule, err := rules.NewForwardRule(nil, $2, $3, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+redirect: REDIRECT string
+    {
+        rule, err := rules.NewRedirectRule(nil, $2, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+vacation: VACATION options
+    {
+        rule, err := yylex.(*Parser).vacation($2)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+options: option
+    | options option
+    { $$ = append($1, $2...) }
+
+option: IDENTIFIER string
+    { $$ = []string{$1, $2} }
+    | IDENTIFIER NUMBER
+    { $$ = []string{$1, $2} }
+
+pipe: PIPE string args
+    {
+        rule, err := yylex.(*Parser).pipe(string(rules.StreamContentRFC822), $2, $3)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+    | PIPE IDENTIFIER string args
+    {
+        rule, err := yylex.(*Parser).pipe($2, $3, $4)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+webhook: WEBHOOK IDENTIFIER string
+    {
+        rule, err := rules.NewWebhookRule(nil, $2, $3, false, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+    | WEBHOOK IDENTIFIER string IDENTIFIER IDENTIFIER
+    {
+        if $4 != "with" || $5 != "attachments" {
+            yylex.Error(fmt.Sprintf("unexpected '%s %s', expected 'with attachments'", $4, $5))
+            return -1
+        }
+        rule, err := rules.NewWebhookRule(nil, $2, $3, true, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+save: SAVE IDENTIFIER string
+    {
+        rule, err := rules.NewSaveRule(nil, $2, yylex.(*Parser).resolve($3), nil, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+    | SAVE IDENTIFIER string IDENTIFIER string
+    {
+        if $4 != "matching" {
+            yylex.Error(fmt.Sprintf("unexpected '%s', expected 'matching'", $4))
+            return -1
+        }
+        rexp, err := regexp.Compile($5)
+        if err != nil {
+            yylex.Error(fmt.Sprintf("malformed regex '%s' in save: %v", $5, err))
+            return -1
+        }
+        rule, err := rules.NewSaveRule(nil, $2, yylex.(*Parser).resolve($3), rexp, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+args: /* empty */
+    { $$ = nil }
+    | IDENTIFIER LBRACKET list RBRACKET
+    {
+        if $1 != "args" {
+            yylex.Error(fmt.Sprintf("unexpected '%s', expected 'args'", $1))
+            return -1
+        }
+        $$ = $3
+    }
 
 flag: FLAG
     { $$ = rules.NewFlagRule(nil, "") }
@@ -116,16 +704,29 @@ unflag: UNFLAG
     { $$ = rules.NewUnflagRule(nil, $2) }
 
 stream: STREAM IDENTIFIER string
-    { $$ = rules.NewStreamRule(nil, $2, $3) }
+    {
+        rule, err := rules.NewStreamRule(nil, $2, $3, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
+
+unsubscribe: UNSUBSCRIBE
+    {
+        rule, err := rules.NewUnsubscribeRule(nil, yylex.(*Parser).env)
+        if err != nil {
+            yylex.Error(err.Error())
+            return -1
+        }
+        $$ = rule
+    }
 
 list: string
-    { $$ = append($$, $1) }
-    | IDENTIFIER
-    { $$ = append($$, $1) }
-    | list string
-    { $$ = append($1, $2) }
-    | list IDENTIFIER
-    { $$ = append($1, $2) }
+    { $$ = []string{$1} }
+    | list COMMA string
+    { $$ = append($1, $3) }
 
 string: QUOTE
     { $$ = strings.ReplaceAll(strings.ReplaceAll($1[1:len($1)-1], "\\\"", "\""), "\\\\", "\\") }
@@ -0,0 +1,173 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AddressListFormat is the format of the file backing an AddressList.
+type AddressListFormat string
+
+const (
+	// AddressListFile is a file of addresses and domains, one per line.
+	AddressListFile AddressListFormat = "file"
+	// AddressListContacts is a vCard export, whose EMAIL properties are used.
+	AddressListContacts AddressListFormat = "contacts"
+)
+
+// addressListCheckInterval limits how often the file is checked for changes.
+const addressListCheckInterval = 10 * time.Second
+
+// An AddressList is a set of addresses and domains loaded from a file. It is
+// reloaded when the file changes, so that the list can be edited without
+// restarting.
+type AddressList struct {
+	Format AddressListFormat
+	Path   string
+
+	mu        sync.Mutex
+	checked   time.Time
+	modTime   time.Time
+	size      int64
+	addresses map[string]bool
+	domains   map[string]bool
+}
+
+func NewAddressList(format string, path string) (*AddressList, error) {
+	switch AddressListFormat(format) {
+	case AddressListFile, AddressListContacts:
+	default:
+		return nil, fmt.Errorf("unknown address list format '%s', expected one of [file, contacts]", format)
+	}
+	l := &AddressList{Format: AddressListFormat(format), Path: path}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// MatchString reports whether the address, or its domain or a parent of its
+// domain, is in the list.
+func (l *AddressList) MatchString(address string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.checked) > addressListCheckInterval {
+		if err := l.load(); err != nil {
+			log.Printf("Reload %s: %v", l.Path, err)
+		}
+	}
+
+	address = strings.ToLower(address)
+	if l.addresses[address] {
+		return true
+	}
+	domain := address[strings.LastIndexByte(address, '@')+1:]
+	for domain != "" {
+		if l.domains[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+// load reads the file if it has changed since it was last read.
+func (l *AddressList) load() error {
+	l.checked = time.Now()
+	info, err := os.Stat(l.Path)
+	if err != nil {
+		return fmt.Errorf("address list: %w", err)
+	}
+	if info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return nil
+	}
+	buf, err := os.ReadFile(l.Path)
+	if err != nil {
+		return fmt.Errorf("address list: %w", err)
+	}
+
+	var entries []string
+	switch l.Format {
+	case AddressListFile:
+		entries = readAddressFile(buf)
+	case AddressListContacts:
+		entries = readVCardEmails(buf)
+	}
+	addresses := make(map[string]bool)
+	domains := make(map[string]bool)
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+		if i := strings.IndexByte(entry, '@'); i > 0 {
+			addresses[entry] = true
+		} else {
+			domains[strings.TrimPrefix(entry, "@")] = true
+		}
+	}
+	if l.addresses != nil {
+		log.Printf("Reloaded %s", l.Path)
+	}
+	l.modTime, l.size = info.ModTime(), info.Size()
+	l.addresses, l.domains = addresses, domains
+	return nil
+}
+
+func (l *AddressList) String() string {
+	return fmt.Sprintf("in %s \"%s\"", l.Format, l.Path)
+}
+
+// readAddressFile reads an address or domain from each line, ignoring blank
+// lines and comments starting with #.
+func readAddressFile(buf []byte) []string {
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries
+}
+
+// readVCardEmails reads the EMAIL properties of each card in a vCard file, as
+// described in RFC 6350.
+func readVCardEmails(buf []byte) []string {
+	// Unfold continuation lines, which begin with a space or tab
+	text := strings.ReplaceAll(string(buf), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n ", "")
+	text = strings.ReplaceAll(text, "\n\t", "")
+
+	var emails []string
+	for _, line := range strings.Split(text, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// Strip parameters (EMAIL;TYPE=work) and groups (item1.EMAIL)
+		name, _, _ = strings.Cut(name, ";")
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		}
+		if strings.EqualFold(name, "EMAIL") {
+			if value = strings.TrimSpace(value); value != "" {
+				emails = append(emails, value)
+			}
+		}
+	}
+	return emails
+}
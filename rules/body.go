@@ -0,0 +1,256 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// bodySection is the entire message, fetched only for rules which inspect
+// the message body.
+var bodySection = &imap.BodySectionName{Peek: true}
+
+// fetcher is implemented by predicates and rules which need message items
+// beyond those fetched by default.
+type fetcher interface {
+	fetchItems() []imap.FetchItem
+}
+
+func predicateFetchItems(predicate Predicate) []imap.FetchItem {
+	if p, ok := predicate.(fetcher); ok {
+		return p.fetchItems()
+	}
+	return nil
+}
+
+// bodyInspector is implemented by predicates which inspect the message body.
+// Bodies aren't fetched with the rest of the message, as that would download
+// the whole mailbox whenever it changes. Instead each predicate caches what
+// it needs from a body, and bodies are fetched in a second pass for just the
+// messages which the predicates haven't seen and whose other predicates
+// don't decide the rule without them.
+type bodyInspector interface {
+	// needsBody reports whether the body of msg must be fetched to decide
+	// whether the predicate matches.
+	needsBody(msg *imap.Message) bool
+	// loadBody caches what the predicate needs from raw, the full text of
+	// msg.
+	loadBody(ctx context.Context, msg *imap.Message, raw []byte)
+}
+
+func predicateNeedsBody(predicate Predicate, msg *imap.Message) bool {
+	if p, ok := predicate.(bodyInspector); ok {
+		return p.needsBody(msg)
+	}
+	return false
+}
+
+func predicateLoadBody(ctx context.Context, predicate Predicate, msg *imap.Message, raw []byte) {
+	if p, ok := predicate.(bodyInspector); ok {
+		p.loadBody(ctx, msg, raw)
+	}
+}
+
+// observer is implemented by predicates which keep a history of the
+// messages in a mailbox, such as rate predicates.
+type observer interface {
+	observe(msg *imap.Message)
+}
+
+func predicateObserve(predicate Predicate, msg *imap.Message) {
+	if p, ok := predicate.(observer); ok {
+		p.observe(msg)
+	}
+}
+
+// Observe records msg in the histories kept by the rules' predicates. It is
+// called for each message fetched, before any rule is given it, so that the
+// histories don't depend on which predicates the rules evaluate.
+func Observe(rules []Rule, msg *imap.Message) {
+	for _, rule := range rules {
+		if r, ok := rule.(conditional); ok {
+			predicateObserve(r.condition(), msg)
+		}
+	}
+}
+
+// conditional is implemented by rules which act on the messages matching a
+// predicate.
+type conditional interface {
+	condition() Predicate
+}
+
+// NeedsBody reports whether any of the rules must inspect the body of msg,
+// fetched with LoadBodies, to decide whether it matches.
+func NeedsBody(rules []Rule, msg *imap.Message) bool {
+	for _, rule := range rules {
+		if r, ok := rule.(conditional); ok && predicateNeedsBody(r.condition(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Undecided reports whether rule still needs the body of msg to decide
+// whether it matches after LoadBodies, because the body couldn't be fetched
+// or inspected, for example when a classifier failed. Such a rule should not
+// be given msg until a later pass can decide it, as a predicate which can't
+// tell would be inverted by `not`.
+func Undecided(rule Rule, msg *imap.Message) bool {
+	r, ok := rule.(conditional)
+	return ok && predicateNeedsBody(r.condition(), msg)
+}
+
+// LoadBodies fetches the bodies of msgs, for which NeedsBody reported that
+// rules must inspect them, and caches what the rules need of them. The
+// bodies themselves are not kept.
+func LoadBodies(ctx context.Context, c *client.Client, rules []Rule, msgs []*imap.Message) error {
+	uids := new(imap.SeqSet)
+	byUID := make(map[uint32]*imap.Message)
+	for _, msg := range msgs {
+		uids.AddNum(msg.Uid)
+		byUID[msg.Uid] = msg
+	}
+	if uids.Empty() {
+		return nil
+	}
+	return fetchBodies(c, uids, func(fetched *imap.Message, raw []byte) {
+		msg, ok := byUID[fetched.Uid]
+		if !ok || raw == nil {
+			return
+		}
+		for _, rule := range rules {
+			if r, ok := rule.(conditional); ok {
+				predicateLoadBody(ctx, r.condition(), msg, raw)
+			}
+		}
+	})
+}
+
+// fetchBodies fetches the full text of messages for rules which act on it,
+// calling fn with each message and its RFC 822 bytes. The messages are not
+// marked \Seen.
+func fetchBodies(c *client.Client, uids *imap.SeqSet, fn func(msg *imap.Message, raw []byte)) error {
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, bodySection.FetchItem()}
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(uids, items, messages)
+	}()
+	for msg := range messages {
+		fn(msg, messageSection(msg, bodySection))
+	}
+	return <-done
+}
+
+// messagePart is a leaf part of a MIME message, with its body decoded.
+type messagePart struct {
+	Header      textproto.MIMEHeader
+	MediaType   string
+	Params      map[string]string
+	Disposition string
+	Filename    string
+	Body        []byte
+}
+
+// messageParts parses raw, the full text of a message, into its leaf parts.
+func messageParts(raw []byte) ([]messagePart, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parse message: %w", err)
+	}
+	var parts []messagePart
+	err = walkParts(textproto.MIMEHeader(m.Header), m.Body, func(part messagePart) {
+		parts = append(parts, part)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse message: %w", err)
+	}
+	return parts, nil
+}
+
+// walkParts calls fn with each leaf part of a MIME entity, descending into
+// nested multipart entities such as multipart/alternative within
+// multipart/mixed.
+func walkParts(header textproto.MIMEHeader, body io.Reader, fn func(messagePart)) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 defaults to plain text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("read %s part: %w", mediaType, err)
+			}
+			if err := walkParts(part.Header, part, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	part := messagePart{Header: header, MediaType: mediaType, Params: params}
+	if disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Disposition = disposition
+		part.Filename = dparams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	if part.Filename != "" {
+		dec := new(mime.WordDecoder)
+		if filename, err := dec.DecodeHeader(part.Filename); err == nil {
+			part.Filename = filename
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	part.Body, err = io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("decode %s part: %w", mediaType, err)
+	}
+	fn(part)
+	return nil
+}
+
+// isAttachment reports whether part is an attachment rather than a body of
+// the message: it is marked as one, or is named.
+func isAttachment(part messagePart) bool {
+	return part.Disposition == "attachment" || part.Filename != ""
+}
+
+// partText returns the body of a text part decoded from its charset, which
+// defaults to US-ASCII. Text in an unknown charset is returned with its
+// invalid bytes replaced.
+func partText(part messagePart) string {
+	if charset := part.Params["charset"]; charset != "" {
+		if enc, err := htmlindex.Get(charset); err == nil {
+			if text, err := enc.NewDecoder().Bytes(part.Body); err == nil {
+				return string(text)
+			}
+		}
+	}
+	return strings.ToValidUTF8(string(part.Body), "\uFFFD")
+}
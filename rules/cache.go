@@ -0,0 +1,53 @@
+package rules
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A cache holds at most size values, evicting the least recently used, so
+// that what the daemon remembers about messages doesn't grow without bound.
+type cache[V any] struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newCache[V any](size int) *cache[V] {
+	return &cache[V]{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *cache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry[V]).value, true
+}
+
+func (c *cache[V]) put(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry[V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[V]).key)
+	}
+}
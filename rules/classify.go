@@ -0,0 +1,191 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// A Classifier labels or scores messages by posting them to a web service,
+// such as a model in the same cluster. The service responds with a JSON
+// object, `{"label": "promotions", "score": 0.93}`, or with the label or
+// score alone as plain text. Recent results are cached by Message-ID so that
+// each message is classified once, however many rules use the classifier,
+// and its body fetched only for that.
+type Classifier struct {
+	URL     string
+	Content StreamContent
+	client  *http.Client
+	timeout time.Duration
+	results *cache[Classification] // by messageKey
+}
+
+type Classification struct {
+	Label string
+	Score float64
+	// Whether the service returned a score.
+	Scored bool
+}
+
+// DefaultClassifyTimeout bounds each request to a classifier if the
+// environment sets no timeout.
+const DefaultClassifyTimeout = 10 * time.Second
+
+// classifierCacheSize bounds the number of messages whose classification
+// each classifier caches.
+const classifierCacheSize = 10000
+
+func NewClassifier(content string, url string, env *Environment) (*Classifier, error) {
+	c, err := parseStreamContent(content)
+	if err != nil {
+		return nil, err
+	}
+	timeout := env.ClassifyTimeout
+	if timeout == 0 {
+		timeout = DefaultClassifyTimeout
+	}
+	return &Classifier{
+		URL:     url,
+		Content: c,
+		client:  env.httpClient(),
+		timeout: timeout,
+		results: newCache[Classification](classifierCacheSize),
+	}, nil
+}
+
+// classified returns the cached classification of msg.
+func (c *Classifier) classified(msg *imap.Message) (Classification, bool) {
+	return c.results.get(messageKey(msg))
+}
+
+// classify returns the classification of msg, calling the service with raw,
+// its full text, if msg has not been classified before.
+func (c *Classifier) classify(ctx context.Context, msg *imap.Message, raw []byte) (Classification, bool) {
+	if result, ok := c.classified(msg); ok {
+		return result, true
+	}
+
+	result, err := c.request(ctx, raw)
+	if err != nil {
+		// Not cached, so that the message is classified again next time
+		log.Printf("classify message %d with `%s`: %v", msg.Uid, c.URL, err)
+		return Classification{}, false
+	}
+	c.results.put(messageKey(msg), result)
+	return result, true
+}
+
+func (c *Classifier) request(ctx context.Context, buf []byte) (Classification, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := newContentRequest(ctx, c.Content, c.URL, bytes.NewReader(buf))
+	if err != nil {
+		return Classification{}, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Classification{}, fmt.Errorf("do http request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Classification{}, fmt.Errorf("error response: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Classification{}, fmt.Errorf("read response: %w", err)
+	}
+	return parseClassification(resp.Header.Get("Content-Type"), body)
+}
+
+// parseClassification parses the response of a classifier.
+func parseClassification(contentType string, body []byte) (Classification, error) {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" {
+		var v struct {
+			Label string   `json:"label"`
+			Score *float64 `json:"score"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return Classification{}, fmt.Errorf("parse response: %w", err)
+		}
+		result := Classification{Label: v.Label}
+		if v.Score != nil {
+			result.Score, result.Scored = *v.Score, true
+		}
+		return result, nil
+	}
+	text := strings.TrimSpace(string(body))
+	if score, err := strconv.ParseFloat(text, 64); err == nil {
+		return Classification{Score: score, Scored: true}, nil
+	}
+	return Classification{Label: text}, nil
+}
+
+func (c *Classifier) String() string {
+	if c.Content == StreamContentRFC822 {
+		return fmt.Sprintf("classify \"%s\"", c.URL)
+	}
+	return fmt.Sprintf("classify %s \"%s\"", c.Content, c.URL)
+}
+
+// ClassifyPredicate matches the label a classifier gives a message or
+// compares its score with a threshold.
+type ClassifyPredicate struct {
+	Classifier *Classifier
+	// Label matches the label, if set. Otherwise the score is compared.
+	Label      StringPredicate
+	Comparison Comparison
+	Threshold  float64
+}
+
+func (p *ClassifyPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	result, ok := p.Classifier.classified(msg)
+	if !ok {
+		return nil, false
+	}
+	if p.Label != nil {
+		return matchString(p.Label, result.Label)
+	}
+	if !result.Scored {
+		return nil, false
+	}
+	switch p.Comparison {
+	case LessThan:
+		return nil, result.Score < p.Threshold
+	case GreaterThan:
+		return nil, result.Score > p.Threshold
+	}
+	return nil, false
+}
+
+func (p *ClassifyPredicate) bindings() []string {
+	if p.Label == nil {
+		return nil
+	}
+	return stringPredicateBindings(p.Label)
+}
+
+func (p *ClassifyPredicate) needsBody(msg *imap.Message) bool {
+	_, ok := p.Classifier.classified(msg)
+	return !ok
+}
+
+func (p *ClassifyPredicate) loadBody(ctx context.Context, msg *imap.Message, raw []byte) {
+	p.Classifier.classify(ctx, msg, raw)
+}
+
+func (p *ClassifyPredicate) String() string {
+	if p.Label != nil {
+		return formatStringPredicate(p.Classifier.String(), p.Label)
+	}
+	return fmt.Sprintf("%s %s %s", p.Classifier, p.Comparison, strconv.FormatFloat(p.Threshold, 'f', -1, 64))
+}
@@ -0,0 +1,73 @@
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		negate bool
+		want   bool
+	}{
+		{"match", http.StatusOK, false, true},
+		{"no match", http.StatusOK, true, false},
+		// A failed classification leaves the message to the next pass,
+		// rather than not matching, which not would invert
+		{"failed", http.StatusInternalServerError, false, false},
+		{"failed negated", http.StatusInternalServerError, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"label": "promotions", "score": 0.93}`))
+			}))
+			defer server.Close()
+			classifier, err := NewClassifier("rfc822", server.URL, &Environment{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var predicate Predicate = &ClassifyPredicate{Classifier: classifier, Label: StringEqualsPredicate("promotions")}
+			if tt.negate {
+				predicate = &NotPredicate{Predicate: predicate}
+			}
+			c := testClient(t)
+			runRules(t, c, NewFlagRule(predicate, "Classified"))
+
+			if got := hasFlag(t, c, "Classified"); got != tt.want {
+				t.Errorf("flagged %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// hasFlag reports whether any message in the selected mailbox has flag.
+func hasFlag(t *testing.T, c *client.Client, flag string) bool {
+	t.Helper()
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchFlags}, messages)
+	}()
+	found := false
+	for msg := range messages {
+		for _, f := range msg.Flags {
+			found = found || strings.EqualFold(f, flag)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
@@ -0,0 +1,141 @@
+package rules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// scriptedServer is an IMAP server which answers UID COPY with a fixed
+// response, and anything else with OK, recording the commands it is sent.
+type scriptedServer struct {
+	caps string
+	copy string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// newScriptedClient starts a scriptedServer, returning it and a client
+// logged in to it with INBOX selected.
+func newScriptedClient(t *testing.T, s *scriptedServer) *client.Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.serve(conn)
+	}()
+	c, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (s *scriptedServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "* OK [CAPABILITY %s] ready\r\n", s.caps)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+		switch upper := strings.ToUpper(command); {
+		case strings.HasPrefix(upper, "CAPABILITY"):
+			fmt.Fprintf(conn, "* CAPABILITY %s\r\n%s OK done\r\n", s.caps, tag)
+		case strings.HasPrefix(upper, "SELECT"):
+			fmt.Fprintf(conn, "* 3 EXISTS\r\n* OK [UIDVALIDITY 1] ok\r\n%s OK [READ-WRITE] done\r\n", tag)
+		case strings.HasPrefix(upper, "UID COPY"):
+			fmt.Fprintf(conn, "%s %s\r\n", tag, s.copy)
+		case strings.HasPrefix(upper, "LOGOUT"):
+			fmt.Fprintf(conn, "* BYE\r\n%s OK done\r\n", tag)
+			return
+		default:
+			fmt.Fprintf(conn, "%s OK done\r\n", tag)
+		}
+	}
+}
+
+// sent returns the commands received whose name starts with prefix.
+func (s *scriptedServer) sent(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var commands []string
+	for _, command := range s.commands {
+		if strings.HasPrefix(strings.ToUpper(command), prefix) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func TestCopy(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		copies   map[uint32]uint32 // by original uid
+	}{
+		{"copyuid", "OK [COPYUID 7 2:3 10:11] done", map[uint32]uint32{2: 10, 3: 11}},
+		{"no uidplus", "OK done", nil},
+		// The messages are copied, so they are recorded regardless
+		{"malformed copyuid", "OK [COPYUID 7 2:3 10] done", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scriptedServer{caps: "IMAP4rev1 UIDPLUS", copy: tt.response}
+			c := newScriptedClient(t, s)
+			rule, err := NewCopyRule(&NotPredicate{Predicate: &BulkPredicate{}}, "Receipts", &Environment{Store: NewStore("")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := []*imap.Message{
+				{Uid: 2, Envelope: &imap.Envelope{MessageId: "<receipt-2@example.com>"}},
+				{Uid: 3, Envelope: &imap.Envelope{MessageId: "<receipt-3@example.com>"}},
+			}
+			for pass := 0; pass < 2; pass++ {
+				for _, msg := range msgs {
+					rule.Message(msg)
+				}
+				if err := rule.Action(context.Background(), c); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := s.sent("UID COPY"); len(got) != 1 {
+				t.Errorf("sent %q, want one UID COPY", got)
+			}
+			for _, msg := range msgs {
+				uid, ok := rule.Copied("Receipts", msg)
+				want, wantOK := tt.copies[msg.Uid]
+				if uid != want || ok != wantOK {
+					t.Errorf("copy of %d is %d, %t, want %d, %t", msg.Uid, uid, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
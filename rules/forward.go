@@ -0,0 +1,308 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// ForwardRule forwards matching messages through the SMTP relay, attached as
+// message/rfc822 or with their text inline. Each message is forwarded to an
+// address at most once.
+type ForwardRule struct {
+	Predicate Predicate
+	To        string
+	Inline    bool
+	relay     *SMTPRelay
+	ledger    *Ledger
+	messages  *imap.SeqSet
+	keys      map[uint32]string // ledger key, by message uid
+}
+
+func NewForwardRule(predicate Predicate, mode string, to string, env *Environment) (*ForwardRule, error) {
+	var inline bool
+	switch mode {
+	case "attached":
+	case "inline":
+		inline = true
+	default:
+		return nil, fmt.Errorf("unknown forward mode '%s', expected one of [attached, inline]", mode)
+	}
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return nil, fmt.Errorf("malformed address '%s': %w", to, err)
+	}
+	if env.SMTP == nil {
+		return nil, fmt.Errorf("forward requires an smtp relay, given by --smtp-host")
+	}
+	ledger, err := env.Store.Ledger("forward")
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardRule{
+		Predicate: predicate,
+		To:        addr.Address,
+		Inline:    inline,
+		relay:     env.SMTP,
+		ledger:    ledger,
+		messages:  new(imap.SeqSet),
+		keys:      make(map[uint32]string),
+	}, nil
+}
+
+// sentKey identifies the sending of msg to an address in a ledger.
+func sentKey(to string, msg *imap.Message) string {
+	id := normalizeMessageID(msg.Envelope.MessageId)
+	if id == "" {
+		id = fmt.Sprintf("uid %d", msg.Uid)
+	}
+	return strings.ToLower(to) + " " + id
+}
+
+func (r ForwardRule) Message(msg *imap.Message) {
+	key := sentKey(r.To, msg)
+	if r.ledger.Done(key) {
+		return // forwarded previously
+	}
+	if _, ok := r.Predicate.MatchMessage(msg); ok {
+		log.Printf("Forwarding '%s' to '%s'", msg.Envelope.Subject, r.To)
+		r.messages.AddNum(msg.Uid)
+		r.keys[msg.Uid] = key
+	}
+}
+
+func (r *ForwardRule) Action(ctx context.Context, client *client.Client) error {
+	msgs := r.messages
+	keys := r.keys
+	r.messages = new(imap.SeqSet)
+	r.keys = make(map[uint32]string)
+	return sendOnce(client, msgs, keys, r.ledger, func(msg *imap.Message, raw []byte) error {
+		if err := r.forward(ctx, msg, raw); err != nil {
+			return fmt.Errorf("forward message %d to `%s`: %w", msg.Uid, r.To, err)
+		}
+		return nil
+	})
+}
+
+// sendOnce fetches messages and calls send with each whose key, by uid, is
+// not yet in the ledger. Keys are forgotten if send fails, so that the
+// message is sent the next time the rules run.
+func sendOnce(client *client.Client, msgs *imap.SeqSet, keys map[uint32]string, ledger *Ledger, send func(msg *imap.Message, raw []byte) error) error {
+	if msgs.Empty() {
+		return nil
+	}
+	var errs []error
+	err := fetchBodies(client, msgs, func(msg *imap.Message, raw []byte) {
+		key := keys[msg.Uid]
+		if !ledger.Record(key, "") {
+			return // sent by another rule
+		}
+		if raw == nil {
+			ledger.Forget(key)
+			errs = append(errs, fmt.Errorf("message %d: body not fetched", msg.Uid))
+			return
+		}
+		if err := send(msg, raw); err != nil {
+			ledger.Forget(key)
+			errs = append(errs, err)
+		}
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("fetch messages: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *ForwardRule) forward(ctx context.Context, msg *imap.Message, raw []byte) error {
+	original, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("parse message: %w", err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", r.relay.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", r.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Fwd: "+msg.Envelope.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", newMessageID(r.relay.From))
+	if id := msg.Envelope.MessageId; id != "" {
+		fmt.Fprintf(&buf, "References: %s\r\n", id)
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	summary := forwardSummary(original.Header)
+	if r.Inline {
+		// Quoted-printable keeps lines within the limit of SMTP, however
+		// long the original's
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		w := quotedprintable.NewWriter(&buf)
+		w.Write([]byte(crlf(summary + "\n" + messageText(original))))
+		if err := w.Close(); err != nil {
+			return err
+		}
+	} else {
+		w := multipart.NewWriter(&buf)
+		fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+		part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+		if err != nil {
+			return err
+		}
+		part.Write([]byte(crlf(summary)))
+		part, err = w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"message/rfc822"},
+			"Content-Disposition": {"inline"},
+		})
+		if err != nil {
+			return err
+		}
+		part.Write(raw)
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return r.relay.Send(ctx, []string{r.To}, buf.Bytes())
+}
+
+// forwardSummary describes a forwarded message, above its text or
+// attachment.
+func forwardSummary(header mail.Header) string {
+	dec := new(mime.WordDecoder)
+	var b strings.Builder
+	b.WriteString("---------- Forwarded message ----------\n")
+	for _, name := range []string{"From", "Date", "Subject", "To", "Cc"} {
+		if value := header.Get(name); value != "" {
+			if decoded, err := dec.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	return b.String()
+}
+
+// messageText returns the first plain text part of a message, decoded from
+// its charset.
+func messageText(msg *mail.Message) string {
+	var text string
+	found := false
+	walkParts(textproto.MIMEHeader(msg.Header), msg.Body, func(part messagePart) {
+		if found || part.MediaType != "text/plain" || part.Disposition == "attachment" {
+			return
+		}
+		found = true
+		text = partText(part)
+	})
+	return text
+}
+
+// crlf converts line endings to CRLF, as required by SMTP.
+func crlf(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func (r *ForwardRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *ForwardRule) fetchItems() []imap.FetchItem {
+	return predicateFetchItems(r.Predicate)
+}
+
+func (r *ForwardRule) String() string {
+	if r.Inline {
+		return fmt.Sprintf("if %s then forward inline \"%s\"", r.Predicate, r.To)
+	}
+	return fmt.Sprintf("if %s then forward \"%s\"", r.Predicate, r.To)
+}
+
+// RedirectRule resends matching messages unchanged to another address,
+// adding Resent-* headers as described in RFC 5322, so that the recipient
+// sees the original sender and subject. Each message is redirected to an
+// address at most once.
+type RedirectRule struct {
+	Predicate Predicate
+	To        string
+	relay     *SMTPRelay
+	ledger    *Ledger
+	messages  *imap.SeqSet
+	keys      map[uint32]string // ledger key, by message uid
+}
+
+func NewRedirectRule(predicate Predicate, to string, env *Environment) (*RedirectRule, error) {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return nil, fmt.Errorf("malformed address '%s': %w", to, err)
+	}
+	if env.SMTP == nil {
+		return nil, fmt.Errorf("redirect requires an smtp relay, given by --smtp-host")
+	}
+	ledger, err := env.Store.Ledger("redirect")
+	if err != nil {
+		return nil, err
+	}
+	return &RedirectRule{
+		Predicate: predicate,
+		To:        addr.Address,
+		relay:     env.SMTP,
+		ledger:    ledger,
+		messages:  new(imap.SeqSet),
+		keys:      make(map[uint32]string),
+	}, nil
+}
+
+func (r RedirectRule) Message(msg *imap.Message) {
+	key := sentKey(r.To, msg)
+	if r.ledger.Done(key) {
+		return // redirected previously
+	}
+	if _, ok := r.Predicate.MatchMessage(msg); ok {
+		log.Printf("Redirecting '%s' to '%s'", msg.Envelope.Subject, r.To)
+		r.messages.AddNum(msg.Uid)
+		r.keys[msg.Uid] = key
+	}
+}
+
+func (r *RedirectRule) Action(ctx context.Context, client *client.Client) error {
+	msgs := r.messages
+	keys := r.keys
+	r.messages = new(imap.SeqSet)
+	r.keys = make(map[uint32]string)
+	return sendOnce(client, msgs, keys, r.ledger, func(msg *imap.Message, raw []byte) error {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "Resent-From: %s\r\n", r.relay.From)
+		fmt.Fprintf(&buf, "Resent-To: %s\r\n", r.To)
+		fmt.Fprintf(&buf, "Resent-Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		fmt.Fprintf(&buf, "Resent-Message-ID: %s\r\n", newMessageID(r.relay.From))
+		buf.Write(raw)
+		if err := r.relay.Send(ctx, []string{r.To}, buf.Bytes()); err != nil {
+			return fmt.Errorf("redirect message %d to `%s`: %w", msg.Uid, r.To, err)
+		}
+		return nil
+	})
+}
+
+func (r *RedirectRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *RedirectRule) fetchItems() []imap.FetchItem {
+	return predicateFetchItems(r.Predicate)
+}
+
+func (r *RedirectRule) String() string {
+	return fmt.Sprintf("if %s then redirect \"%s\"", r.Predicate, r.To)
+}
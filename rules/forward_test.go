@@ -0,0 +1,213 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const invoice = `From: Alice <alice@example.com>
+To: me@example.com
+Subject: Invoice
+Date: Mon, 02 Mar 2026 09:00:00 +0000
+Message-ID: <invoice@example.com>
+Content-Type: text/plain; charset=utf-8
+
+Please find this month's invoice attached.
+`
+
+// submission is a message received by an smtpStandIn.
+type submission struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpStandIn is a local SMTP server which accepts any mail, without TLS or
+// authentication, recording what it is sent.
+type smtpStandIn struct {
+	mu          sync.Mutex
+	submissions []submission
+}
+
+// newSMTPStandIn starts an smtpStandIn, returning it and a relay which
+// submits mail to it.
+func newSMTPStandIn(t *testing.T) (*smtpStandIn, *SMTPRelay) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := new(smtpStandIn)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, &SMTPRelay{Addr: ln.Addr().String(), From: "me@example.com"}
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost\r\n")
+	var sub submission
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case "MAIL":
+			sub = submission{from: envelopeAddress(arg)}
+			fmt.Fprint(conn, "250 ok\r\n")
+		case "RCPT":
+			sub.to = append(sub.to, envelopeAddress(arg))
+			fmt.Fprint(conn, "250 ok\r\n")
+		case "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			sub.data = data.String()
+			s.mu.Lock()
+			s.submissions = append(s.submissions, sub)
+			s.mu.Unlock()
+			fmt.Fprint(conn, "250 ok\r\n")
+		case "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+// received returns the messages submitted so far.
+func (s *smtpStandIn) received() []submission {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]submission(nil), s.submissions...)
+}
+
+// envelopeAddress returns the address of a MAIL FROM or RCPT TO argument,
+// such as `TO:<a@example.com>`.
+func envelopeAddress(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path, _, _ = strings.Cut(path, " ")
+	return strings.Trim(path, "<>")
+}
+
+func TestForward(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"attached", []string{
+			"To: assistant@example.com\r\n",
+			"Subject: Fwd: Invoice\r\n",
+			"References: <invoice@example.com>\r\n",
+			"From: Alice <alice@example.com>\r\n",
+			"Content-Type: message/rfc822\r\n",
+			"Message-ID: <invoice@example.com>\r\n",
+			"Please find this month's invoice attached.",
+		}},
+		{"inline", []string{
+			"To: assistant@example.com\r\n",
+			"Subject: Fwd: Invoice\r\n",
+			"References: <invoice@example.com>\r\n",
+			"Content-Transfer-Encoding: quoted-printable\r\n",
+			"From: Alice <alice@example.com>\r\n",
+			"Please find this month's invoice attached.",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			smtp, relay := newSMTPStandIn(t)
+			env := &Environment{Store: NewStore(""), SMTP: relay}
+			c := testClient(t, invoice)
+
+			rule, err := NewForwardRule(subjectIs(t, "Invoice"), tt.mode, "assistant@example.com", env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runRules(t, c, rule)
+			// Forwarded messages are recorded, by this and any other rule
+			runRules(t, c, rule)
+			again, err := NewForwardRule(subjectIs(t, "Invoice"), tt.mode, "assistant@example.com", env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runRules(t, c, again)
+
+			got := smtp.received()
+			if len(got) != 1 {
+				t.Fatalf("forwarded %d messages, want 1", len(got))
+			}
+			if got[0].from != "me@example.com" {
+				t.Errorf("MAIL FROM <%s>, want <me@example.com>", got[0].from)
+			}
+			if len(got[0].to) != 1 || got[0].to[0] != "assistant@example.com" {
+				t.Errorf("RCPT TO %q, want [assistant@example.com]", got[0].to)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got[0].data, want) {
+					t.Errorf("forwarded message lacks %q:\n%s", want, got[0].data)
+				}
+			}
+		})
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	smtp, relay := newSMTPStandIn(t)
+	env := &Environment{Store: NewStore(""), SMTP: relay}
+	c := testClient(t, invoice)
+
+	rule, err := NewRedirectRule(subjectIs(t, "Invoice"), "Archive <archive@example.net>", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runRules(t, c, rule)
+	runRules(t, c, rule)
+
+	got := smtp.received()
+	if len(got) != 1 {
+		t.Fatalf("redirected %d messages, want 1", len(got))
+	}
+	if len(got[0].to) != 1 || got[0].to[0] != "archive@example.net" {
+		t.Errorf("RCPT TO %q, want [archive@example.net]", got[0].to)
+	}
+	for _, want := range []string{
+		"Resent-From: me@example.com\r\n",
+		"Resent-To: archive@example.net\r\n",
+		"Resent-Message-ID: <",
+		"From: Alice <alice@example.com>\r\n",
+		"Subject: Invoice\r\n",
+		"Message-ID: <invoice@example.com>\r\n",
+	} {
+		if !strings.Contains(got[0].data, want) {
+			t.Errorf("redirected message lacks %q:\n%s", want, got[0].data)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Identities are the user's own addresses. Each is a pattern which may
+// contain wildcards, such as `*+*@example.com` for subaddresses.
+type Identities struct {
+	Patterns []string
+}
+
+func (ids *Identities) Add(patterns ...string) error {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("malformed identity '%s': %w", pattern, err)
+		}
+		ids.Patterns = append(ids.Patterns, pattern)
+	}
+	return nil
+}
+
+// Match reports whether address is one of the user's own.
+func (ids *Identities) Match(address string) bool {
+	address = strings.ToLower(address)
+	for _, pattern := range ids.Patterns {
+		if ok, _ := path.Match(pattern, address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityPredicate matches messages addressed to one of the user's
+// identities. The `to` field considers both the To and Cc recipients, so that
+// `not to me` matches mail delivered by a list or Bcc.
+type IdentityPredicate struct {
+	Field      string
+	Only       bool // all recipients are the user
+	Identities *Identities
+}
+
+func NewIdentityPredicate(field string, only bool, identities *Identities) (*IdentityPredicate, error) {
+	switch field {
+	case "to", "cc":
+	default:
+		return nil, fmt.Errorf("unknown field '%s' for 'me', expected one of [to, cc]", field)
+	}
+	if only && field != "to" {
+		return nil, fmt.Errorf("'only' applies to 'to me' but found '%s me'", field)
+	}
+	return &IdentityPredicate{Field: field, Only: only, Identities: identities}, nil
+}
+
+func (p *IdentityPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	recipients := msg.Envelope.Cc
+	if p.Field == "to" {
+		recipients = append(msg.Envelope.To[:len(msg.Envelope.To):len(msg.Envelope.To)], msg.Envelope.Cc...)
+	}
+	mine := 0
+	for _, address := range recipients {
+		if p.Identities.Match(address.Address()) {
+			mine++
+		}
+	}
+	if p.Only {
+		return nil, mine > 0 && mine == len(recipients)
+	}
+	return nil, mine > 0
+}
+
+func (p *IdentityPredicate) String() string {
+	if p.Only {
+		return fmt.Sprintf("only %s me", p.Field)
+	}
+	return fmt.Sprintf("%s me", p.Field)
+}
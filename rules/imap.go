@@ -0,0 +1,231 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+)
+
+// uidCopy copies messages to mailbox with UID COPY. If the server supports
+// UIDPLUS, as described in RFC 4315, it returns the uid of each copy by the
+// uid of its original, from the COPYUID response code. A malformed COPYUID
+// is logged rather than returned, as the messages were copied regardless.
+func uidCopy(c *client.Client, uids *imap.SeqSet, mailbox string) (map[uint32]uint32, error) {
+	cmd := &commands.Uid{Cmd: &commands.Copy{SeqSet: uids, Mailbox: mailbox}}
+	status, err := executeCreating(c, cmd, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	if status.Code != "COPYUID" {
+		return nil, nil
+	}
+	copies, err := parseCopyUID(status.Arguments)
+	if err != nil {
+		// The messages were copied all the same
+		log.Printf("copy messages to mailbox `%s`: %v", mailbox, err)
+	}
+	return copies, nil
+}
+
+// parseCopyUID parses the arguments of a COPYUID response code, the uid
+// validity of the destination mailbox followed by the uids of the originals
+// and of their copies in corresponding order.
+func parseCopyUID(args []interface{}) (map[uint32]uint32, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("malformed COPYUID %v", args)
+	}
+	source, err := imap.ParseSeqSet(fmt.Sprint(args[1]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed COPYUID %v: %w", args, err)
+	}
+	dest, err := imap.ParseSeqSet(fmt.Sprint(args[2]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed COPYUID %v: %w", args, err)
+	}
+	sources, dests := seqSetUIDs(source), seqSetUIDs(dest)
+	if len(sources) != len(dests) {
+		return nil, fmt.Errorf("malformed COPYUID %v: %d originals but %d copies", args, len(sources), len(dests))
+	}
+	copies := make(map[uint32]uint32, len(sources))
+	for i, uid := range sources {
+		copies[uid] = dests[i]
+	}
+	return copies, nil
+}
+
+// seqSetUIDs lists the uids of a set without `*`, in order.
+func seqSetUIDs(set *imap.SeqSet) []uint32 {
+	var uids []uint32
+	for _, seq := range set.Set {
+		for uid := seq.Start; uid <= seq.Stop; uid++ {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// uidMove moves messages to mailbox with UID MOVE, as described in RFC 6851.
+// Servers without MOVE are sent UID COPY, STORE \Deleted and UID EXPUNGE,
+// which requires UIDPLUS. Unlike client.UidMove, it never falls back to an
+// EXPUNGE which would also remove other messages marked \Deleted.
+func uidMove(c *client.Client, uids *imap.SeqSet, mailbox string) error {
+	if ok, err := c.Support("MOVE"); err != nil {
+		return err
+	} else if ok {
+		_, err := executeCreating(c, &commands.Uid{Cmd: &commands.Move{SeqSet: uids, Mailbox: mailbox}}, mailbox)
+		return err
+	}
+	if err := checkMove(c); err != nil {
+		return err
+	}
+	if _, err := uidCopy(c, uids, mailbox); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	return uidDelete(c, uids)
+}
+
+// executeCreating executes a command which targets mailbox, such as COPY or
+// MOVE. If the server refuses it with TRYCREATE, because the mailbox doesn't
+// exist, the mailbox is created and the command sent again.
+func executeCreating(c *client.Client, cmd imap.Commander, mailbox string) (*imap.StatusResp, error) {
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status.Type == imap.StatusRespNo && status.Code == imap.CodeTryCreate {
+		if err := createMailbox(c, mailbox); err != nil {
+			return nil, fmt.Errorf("create mailbox: %w", err)
+		}
+		if status, err = c.Execute(cmd, nil); err != nil {
+			return nil, err
+		}
+	}
+	return status, status.Err()
+}
+
+// createMailbox creates mailbox along with any parents it lacks, as servers
+// needn't create them, for example `Lists` of `Lists/golang-nuts`.
+func createMailbox(c *client.Client, mailbox string) error {
+	delimiter, err := hierarchyDelimiter(c)
+	if err != nil {
+		return err
+	}
+	if delimiter != "" {
+		names := strings.Split(mailbox, delimiter)
+		for i := 1; i < len(names); i++ {
+			// An error most likely means the parent exists already
+			c.Create(strings.Join(names[:i], delimiter))
+		}
+	}
+	return c.Create(mailbox)
+}
+
+// hierarchyDelimiter returns the separator of mailbox names, which is empty
+// if the server has a flat namespace.
+func hierarchyDelimiter(c *client.Client) (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		// An empty mailbox name lists just the delimiter, as described in
+		// RFC 3501
+		done <- c.List("", "", mailboxes)
+	}()
+	var delimiter string
+	for mailbox := range mailboxes {
+		delimiter = mailbox.Delimiter
+	}
+	if err := <-done; err != nil {
+		return "", fmt.Errorf("list hierarchy delimiter: %w", err)
+	}
+	return delimiter, nil
+}
+
+// errNoMove is returned when a server supports neither MOVE nor UIDPLUS, so
+// that messages can't be moved without expunging other messages.
+var errNoMove = errors.New("server supports neither MOVE nor UIDPLUS, one of which is required to move messages")
+
+// capabilityChecker is implemented by rules which require server extensions.
+type capabilityChecker interface {
+	checkCapabilities(c *client.Client) error
+}
+
+// CheckCapabilities reports an error if the server lacks an extension which
+// any of the rules requires, so that such rules fail when the daemon starts
+// rather than when they first match.
+func CheckCapabilities(c *client.Client, rules []Rule) error {
+	var errs []error
+	for _, rule := range rules {
+		if r, ok := rule.(capabilityChecker); ok {
+			if err := r.checkCapabilities(c); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", rule, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkMove checks that the server can move messages.
+func checkMove(c *client.Client) error {
+	for _, capability := range []string{"MOVE", "UIDPLUS"} {
+		if ok, err := c.Support(capability); err != nil || ok {
+			return err
+		}
+	}
+	return errNoMove
+}
+
+// checkDelete checks that the server can expunge only the targeted messages.
+func checkDelete(c *client.Client) error {
+	if ok, err := c.Support("UIDPLUS"); err != nil {
+		return err
+	} else if !ok {
+		return errNoUIDPlus
+	}
+	return nil
+}
+
+// errNoUIDPlus is returned when a server lacks UIDPLUS, without which
+// expunging would remove every message marked \Deleted, rather than only
+// the messages a rule targets.
+var errNoUIDPlus = errors.New("server doesn't support UIDPLUS, required to expunge only the targeted messages")
+
+// uidDelete marks messages \Deleted and expunges them with UID EXPUNGE, as
+// described in RFC 4315, leaving any other messages marked \Deleted in
+// place.
+func uidDelete(c *client.Client, uids *imap.SeqSet) error {
+	if err := checkDelete(c); err != nil {
+		return err
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(uids, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return fmt.Errorf("mark deleted: %w", err)
+	}
+	return uidExpunge(c, uids)
+}
+
+// uidExpunge expunges messages with UID EXPUNGE.
+func uidExpunge(c *client.Client, uids *imap.SeqSet) error {
+	status, err := c.Execute(&commands.Uid{Cmd: &expungeCommand{SeqSet: uids}}, nil)
+	if err != nil {
+		return fmt.Errorf("expunge: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return fmt.Errorf("expunge: %w", err)
+	}
+	return nil
+}
+
+// expungeCommand is an EXPUNGE command with a set of uids, which is sent as
+// UID EXPUNGE wrapped in commands.Uid.
+type expungeCommand struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *expungeCommand) Command() *imap.Command {
+	return &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{cmd.SeqSet}}
+}
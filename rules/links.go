@@ -0,0 +1,237 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/net/html"
+)
+
+// A link is a URL found in the body of a message.
+type link struct {
+	URL    string
+	Domain string
+	Text   string // visible text of an HTML link
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+// linkCacheSize bounds the number of messages whose links are cached.
+const linkCacheSize = 10000
+
+// linkCache holds the links of messages, by messageKey, so that each body is
+// fetched and parsed once however many predicates inspect it.
+var linkCache = newCache[[]link](linkCacheSize)
+
+// cachedLinks returns the links of msg, parsing them from its body if it was
+// fetched but they weren't cached. It reports false if they are unknown.
+func cachedLinks(msg *imap.Message) ([]link, bool) {
+	key := messageKey(msg)
+	if links, ok := linkCache.get(key); ok {
+		return links, true
+	}
+	raw := messageSection(msg, bodySection)
+	if raw == nil {
+		return nil, false
+	}
+	links := messageLinks(raw)
+	linkCache.put(key, links)
+	return links, true
+}
+
+func needsLinks(msg *imap.Message) bool {
+	_, ok := linkCache.get(messageKey(msg))
+	return !ok
+}
+
+func loadLinks(msg *imap.Message, raw []byte) {
+	if needsLinks(msg) {
+		linkCache.put(messageKey(msg), messageLinks(raw))
+	}
+}
+
+// messageLinks extracts the http and https links from the text and HTML
+// parts of raw, the full text of a message. HTML links are taken from their
+// href, with the text they display recorded separately.
+func messageLinks(raw []byte) []link {
+	parts, err := messageParts(raw)
+	if err != nil {
+		log.Printf("Find links: %v", err)
+		return nil
+	}
+	var links []link
+	for _, part := range parts {
+		if part.Disposition == "attachment" {
+			continue
+		}
+		switch part.MediaType {
+		case "text/plain":
+			for _, u := range linkPattern.FindAllString(string(part.Body), -1) {
+				if l, ok := newLink(strings.TrimRight(u, ".,;:!?"), ""); ok {
+					links = append(links, l)
+				}
+			}
+		case "text/html":
+			links = append(links, htmlLinks(part.Body)...)
+		}
+	}
+	return links
+}
+
+// htmlLinks extracts the anchors of an HTML document.
+func htmlLinks(doc []byte) []link {
+	var links []link
+	var base *url.URL
+	var href string
+	var text strings.Builder
+	inAnchor := false
+	z := html.NewTokenizer(bytes.NewReader(doc))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				attrs[string(k)] = string(v)
+			}
+			switch string(name) {
+			case "base":
+				base, _ = url.Parse(attrs["href"])
+			case "a":
+				inAnchor, href = true, attrs["href"]
+				text.Reset()
+			}
+		case html.TextToken:
+			if inAnchor {
+				text.Write(z.Text())
+				text.WriteByte(' ')
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "a" && inAnchor {
+				inAnchor = false
+				if u, err := url.Parse(strings.TrimSpace(href)); err == nil && base != nil {
+					href = base.ResolveReference(u).String()
+				}
+				if l, ok := newLink(strings.TrimSpace(href), strings.Join(strings.Fields(text.String()), " ")); ok {
+					links = append(links, l)
+				}
+			}
+		}
+	}
+}
+
+func newLink(rawURL string, text string) (link, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return link{}, false
+	}
+	return link{URL: rawURL, Domain: strings.ToLower(u.Hostname()), Text: text}, true
+}
+
+// LinkPredicate matches messages with a link whose URL, domain or visible
+// text matches.
+type LinkPredicate struct {
+	Field     string
+	Predicate StringPredicate
+}
+
+func NewLinkPredicate(field string, predicate StringPredicate) (*LinkPredicate, error) {
+	switch field {
+	case "link", "link.domain", "link.text":
+		return &LinkPredicate{Field: field, Predicate: predicate}, nil
+	default:
+		return nil, fmt.Errorf("unknown field '%s'", field)
+	}
+}
+
+func (p *LinkPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	links, _ := cachedLinks(msg)
+	for _, l := range links {
+		value := l.URL
+		switch p.Field {
+		case "link.domain":
+			value = l.Domain
+		case "link.text":
+			value = l.Text
+		}
+		if bindings, ok := matchString(p.Predicate, value); ok {
+			return bindings, true
+		}
+	}
+	return nil, false
+}
+
+func (p *LinkPredicate) needsBody(msg *imap.Message) bool {
+	return needsLinks(msg)
+}
+
+func (p *LinkPredicate) loadBody(_ context.Context, msg *imap.Message, raw []byte) {
+	loadLinks(msg, raw)
+}
+
+func (p *LinkPredicate) bindings() []string {
+	return stringPredicateBindings(p.Predicate)
+}
+
+func (p *LinkPredicate) String() string {
+	return formatStringPredicate(p.Field, p.Predicate)
+}
+
+// CountPredicate compares the number of links in a message with a threshold.
+type CountPredicate struct {
+	Field      string
+	Comparison Comparison
+	Count      int
+}
+
+func NewCountPredicate(field string, comparison Comparison, count int) (*CountPredicate, error) {
+	switch field {
+	case "links":
+		return &CountPredicate{Field: field, Comparison: comparison, Count: count}, nil
+	default:
+		return nil, fmt.Errorf("unknown count field '%s'", field)
+	}
+}
+
+func (p *CountPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	links, ok := cachedLinks(msg)
+	if !ok {
+		return nil, false
+	}
+	return nil, p.Comparison.compare(int64(len(links)), int64(p.Count))
+}
+
+func (p *CountPredicate) needsBody(msg *imap.Message) bool {
+	return needsLinks(msg)
+}
+
+func (p *CountPredicate) loadBody(_ context.Context, msg *imap.Message, raw []byte) {
+	loadLinks(msg, raw)
+}
+
+func (p *CountPredicate) String() string {
+	return fmt.Sprintf("%s %s %d", p.Field, p.Comparison, p.Count)
+}
+
+// DomainPredicate matches a domain and its subdomains.
+type DomainPredicate string
+
+func (p DomainPredicate) MatchString(s string) bool {
+	domain := strings.ToLower(strings.TrimSuffix(string(p), "."))
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	return s == domain || strings.HasSuffix(s, "."+domain)
+}
+
+func (p DomainPredicate) String() string {
+	return fmt.Sprintf("within \"%s\"", string(p))
+}
@@ -0,0 +1,233 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// listPost extracts the posting address from a List-Post header, as
+// described in RFC 2369, for example `<mailto:list@example.com>`. Lists which
+// don't accept posts have the header `NO`.
+func listPost(header mail.Header) string {
+	for _, uri := range listURIs(header.Get("List-Post")) {
+		if address, ok := mailtoAddress(uri); ok {
+			return strings.ToLower(address)
+		}
+	}
+	return ""
+}
+
+// listURIs extracts the URIs in angle brackets from a list header such as
+// List-Unsubscribe, in order of preference.
+func listURIs(value string) []*url.URL {
+	var uris []*url.URL
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			return uris
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return uris
+		}
+		// Whitespace is permitted within the brackets for folding
+		raw := strings.Join(strings.Fields(value[start+1:start+end]), "")
+		if uri, err := url.Parse(raw); err == nil {
+			uris = append(uris, uri)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+// mailtoAddress returns the first recipient of a mailto URI.
+func mailtoAddress(uri *url.URL) (string, bool) {
+	if !strings.EqualFold(uri.Scheme, "mailto") {
+		return "", false
+	}
+	to, err := url.PathUnescape(uri.Opaque)
+	if err != nil {
+		return "", false
+	}
+	address, _, _ := strings.Cut(to, ",")
+	return address, address != ""
+}
+
+// BulkPredicate matches mail sent to many recipients at once, marked by a
+// Precedence of bulk, list or junk, or by a List-Unsubscribe header.
+type BulkPredicate struct{}
+
+func (p *BulkPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	header := messageHeader(msg)
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return nil, true
+	}
+	return nil, header.Get("List-Unsubscribe") != ""
+}
+
+func (p *BulkPredicate) fetchItems() []imap.FetchItem {
+	return headerItems()
+}
+
+func (p *BulkPredicate) String() string {
+	return "is bulk"
+}
+
+// UnsubscribeRule unsubscribes from the lists which sent matching messages,
+// using one-click unsubscription, as described in RFC 8058, if the list
+// supports it, or else by mailing the list's unsubscribe address. Each list
+// is unsubscribed from at most once, whether or not it succeeds.
+type UnsubscribeRule struct {
+	Predicate Predicate
+	client    *http.Client
+	relay     *SMTPRelay
+	ledger    *Ledger
+	requests  map[string]unsubscribeRequest // by list
+}
+
+type unsubscribeRequest struct {
+	subject  string
+	uris     []*url.URL
+	oneClick bool
+}
+
+func NewUnsubscribeRule(predicate Predicate, env *Environment) (*UnsubscribeRule, error) {
+	ledger, err := env.Store.Ledger("unsubscribe")
+	if err != nil {
+		return nil, err
+	}
+	return &UnsubscribeRule{
+		Predicate: predicate,
+		client:    env.httpClient(),
+		relay:     env.SMTP,
+		ledger:    ledger,
+		requests:  make(map[string]unsubscribeRequest),
+	}, nil
+}
+
+func (r UnsubscribeRule) Message(msg *imap.Message) {
+	header := messageHeader(msg)
+	uris := listURIs(header.Get("List-Unsubscribe"))
+	if len(uris) == 0 {
+		return
+	}
+	list := listID(header)
+	if list == "" {
+		list = strings.ToLower(firstAddress(msg.Envelope.From).Address())
+	}
+	if _, ok := r.requests[list]; ok || r.ledger.Done(list) {
+		return
+	}
+	if _, ok := r.Predicate.MatchMessage(msg); ok {
+		log.Printf("Unsubscribing from '%s' which sent '%s'", list, msg.Envelope.Subject)
+		r.requests[list] = unsubscribeRequest{
+			subject:  msg.Envelope.Subject,
+			uris:     uris,
+			oneClick: strings.EqualFold(strings.TrimSpace(header.Get("List-Unsubscribe-Post")), "List-Unsubscribe=One-Click"),
+		}
+	}
+}
+
+func (r *UnsubscribeRule) Action(ctx context.Context, _ *client.Client) error {
+	requests := r.requests
+	r.requests = make(map[string]unsubscribeRequest)
+
+	var errs []error
+	for list, req := range requests {
+		if !r.ledger.Record(list, "") {
+			continue // unsubscribed by another rule
+		}
+		method, err := r.unsubscribe(ctx, req)
+		if err != nil {
+			r.ledger.Annotate(list, err.Error())
+			errs = append(errs, fmt.Errorf("unsubscribe from `%s`: %w", list, err))
+			continue
+		}
+		r.ledger.Annotate(list, method)
+		log.Printf("Unsubscribed from '%s' by %s", list, method)
+	}
+	return errors.Join(errs...)
+}
+
+// unsubscribe uses the first supported method of the request, returning the
+// URI used.
+func (r *UnsubscribeRule) unsubscribe(ctx context.Context, req unsubscribeRequest) (string, error) {
+	if req.oneClick {
+		for _, uri := range req.uris {
+			if uri.Scheme == "https" {
+				return uri.String(), r.post(ctx, uri)
+			}
+		}
+	}
+	for _, uri := range req.uris {
+		if address, ok := mailtoAddress(uri); ok {
+			if r.relay == nil {
+				return "", fmt.Errorf("no smtp relay to mail `%s`", address)
+			}
+			return uri.String(), r.mail(ctx, address, uri.Query())
+		}
+	}
+	return "", fmt.Errorf("no supported unsubscribe method, the list offers %v", req.uris)
+}
+
+func (r *UnsubscribeRule) post(ctx context.Context, uri *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri.String(), strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		return fmt.Errorf("construct post request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do http request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *UnsubscribeRule) mail(ctx context.Context, address string, query url.Values) error {
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "unsubscribe"
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", r.relay.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", address)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", newMessageID(r.relay.From))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n%s\r\n", strings.ReplaceAll(query.Get("body"), "\n", "\r\n"))
+	return r.relay.Send(ctx, []string{address}, msg.Bytes())
+}
+
+func (r *UnsubscribeRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *UnsubscribeRule) fetchItems() []imap.FetchItem {
+	return append(headerItems(), predicateFetchItems(r.Predicate)...)
+}
+
+func (r *UnsubscribeRule) String() string {
+	return fmt.Sprintf("if %s then unsubscribe", r.Predicate)
+}
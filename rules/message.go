@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// headerSection is the message header, fetched alongside the envelope for
+// predicates and templates which inspect fields the envelope omits.
+var headerSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+	Peek:         true,
+}
+
+// FetchItems lists the items to fetch for each message before it is passed
+// to the rules.
+func FetchItems(rules []Rule) []imap.FetchItem {
+	items := []imap.FetchItem{
+		imap.FetchUid,
+		imap.FetchEnvelope,
+		imap.FetchInternalDate,
+	}
+	for _, rule := range rules {
+		r, ok := rule.(fetcher)
+		if !ok {
+			continue
+		}
+	Items:
+		for _, item := range r.fetchItems() {
+			for _, have := range items {
+				if item == have {
+					continue Items
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// headerItems requests the message header, for predicates and rules which
+// read header fields.
+func headerItems() []imap.FetchItem {
+	return []imap.FetchItem{headerSection.FetchItem()}
+}
+
+// bufferedLiteral is a body section read into memory so that it can be
+// inspected by more than one rule.
+type bufferedLiteral struct {
+	*bytes.Reader
+	buf []byte
+}
+
+// messageSection returns the contents of a fetched body section, or nil if
+// the section was not fetched.
+func messageSection(msg *imap.Message, section *imap.BodySectionName) []byte {
+	literal := msg.GetBody(section)
+	if literal == nil {
+		return nil
+	}
+	if l, ok := literal.(*bufferedLiteral); ok {
+		return l.buf
+	}
+	buf, _ := io.ReadAll(literal)
+	for name, l := range msg.Body {
+		if l == literal {
+			msg.Body[name] = &bufferedLiteral{Reader: bytes.NewReader(buf), buf: buf}
+		}
+	}
+	return buf
+}
+
+// messageHeader parses the fetched header of msg. It is empty if the header
+// was not fetched or is malformed.
+func messageHeader(msg *imap.Message) mail.Header {
+	buf := messageSection(msg, headerSection)
+	if buf == nil {
+		return mail.Header{}
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(buf))
+	if err != nil {
+		return mail.Header{}
+	}
+	return m.Header
+}
+
+// messageKey identifies msg across mailboxes and passes: by its Message-ID
+// or, if it has none, by when it was received and its subject.
+func messageKey(msg *imap.Message) string {
+	if id := normalizeMessageID(msg.Envelope.MessageId); id != "" {
+		return id
+	}
+	return fmt.Sprintf("%d %s", msg.InternalDate.UnixNano(), msg.Envelope.Subject)
+}
+
+// baseSubject strips reply and forward prefixes, such as `Re:` and `Fwd:`,
+// from a subject, loosely following the base subject of RFC 5256.
+func baseSubject(subject string) string {
+	subject = strings.Join(strings.Fields(subject), " ")
+	for {
+		lower := strings.ToLower(subject)
+		trimmed := false
+		for _, prefix := range []string{"re:", "fw:", "fwd:"} {
+			if strings.HasPrefix(lower, prefix) {
+				subject = strings.TrimSpace(subject[len(prefix):])
+				trimmed = true
+				break
+			}
+		}
+		if !trimmed {
+			return subject
+		}
+	}
+}
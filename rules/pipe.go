@@ -0,0 +1,255 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// DefaultPipeTimeout bounds each command if the environment sets no timeout.
+const DefaultPipeTimeout = 30 * time.Second
+
+// DefaultPipeConcurrency is how many commands run at once if the environment
+// sets no limit.
+const DefaultPipeConcurrency = 4
+
+// pipeStderrLimit bounds the standard error of a command which is logged.
+const pipeStderrLimit = 16 << 10
+
+// PipeRule runs a local command for each matching message, with the message
+// on standard input in the form given by Content, as posted by StreamRule,
+// and its attributes in environment variables:
+//
+//	MAILRULES_MAILBOX     the mailbox the message is in
+//	MAILRULES_UID         its UID in the mailbox
+//	MAILRULES_MESSAGE_ID  its Message-ID, without angle brackets
+//	MAILRULES_FROM        the address of its sender
+//	MAILRULES_TO          the addresses it was sent to, separated by commas
+//	MAILRULES_SUBJECT     its subject
+//	MAILRULES_DATE        its date, in RFC 3339 form
+//
+// Each message is piped at most once while the daemon runs. A command which
+// fails or times out is logged, with its standard error, and not retried.
+type PipeRule struct {
+	Predicate Predicate
+	Content   StreamContent
+	Command   string
+	Args      []*Template
+	timeout   time.Duration
+	slots     chan struct{}
+	messages  *imap.SeqSet
+	args      map[uint32][]string // by message uid
+	done      *imap.SeqSet
+}
+
+func NewPipeRule(predicate Predicate, content string, command string, args []string, env *Environment) (*PipeRule, error) {
+	c, err := parseStreamContent(content)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return nil, fmt.Errorf("pipe command: %w", err)
+	}
+	r := &PipeRule{
+		Predicate: predicate,
+		Content:   c,
+		Command:   command,
+		timeout:   env.PipeTimeout,
+		slots:     env.pipeSlots(),
+		messages:  new(imap.SeqSet),
+		args:      make(map[uint32][]string),
+		done:      new(imap.SeqSet),
+	}
+	if r.timeout == 0 {
+		r.timeout = DefaultPipeTimeout
+	}
+	for _, arg := range args {
+		tmpl, err := NewTemplate(arg)
+		if err != nil {
+			return nil, err
+		}
+		r.Args = append(r.Args, tmpl)
+	}
+	return r, nil
+}
+
+// Check reports an error if an argument refers to a capture group predicate
+// doesn't define.
+func (r *PipeRule) Check(predicate Predicate) error {
+	for _, arg := range r.Args {
+		if err := arg.Check(predicate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r PipeRule) Message(msg *imap.Message) {
+	if r.done.Contains(msg.Uid) {
+		return
+	}
+	if bindings, ok := r.Predicate.MatchMessage(msg); ok {
+		log.Printf("Piping '%s' to `%s`", msg.Envelope.Subject, r.Command)
+		args := make([]string, len(r.Args))
+		for i, arg := range r.Args {
+			args[i] = arg.Expand(msg, bindings)
+		}
+		r.messages.AddNum(msg.Uid)
+		r.args[msg.Uid] = args
+	}
+}
+
+func (r *PipeRule) Action(ctx context.Context, client *client.Client) error {
+	msgs := r.messages
+	args := r.args
+	r.messages = new(imap.SeqSet)
+	r.args = make(map[uint32][]string)
+	r.done.AddSet(msgs)
+	if msgs.Empty() {
+		return nil
+	}
+
+	var mailbox string
+	if status := client.Mailbox(); status != nil {
+		mailbox = status.Name
+	}
+	var wg sync.WaitGroup
+	err := fetchBodies(client, msgs, func(msg *imap.Message, raw []byte) {
+		if raw == nil {
+			log.Printf("pipe message %d to `%s`: body not fetched", msg.Uid, r.Command)
+			return
+		}
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-r.slots }()
+			if err := r.run(ctx, mailbox, msg, raw, args[msg.Uid]); err != nil {
+				log.Printf("pipe message %d to `%s`: %v", msg.Uid, r.Command, err)
+			}
+		}()
+	})
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("pipe messages to `%s`: %w", r.Command, err)
+	}
+	return nil
+}
+
+// run runs the command for msg, logging what it writes to standard error.
+func (r *PipeRule) run(ctx context.Context, mailbox string, msg *imap.Message, raw []byte, args []string) error {
+	stdin, err := pipeContent(r.Content, raw)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, r.Command, args...)
+	cmd.Env = append(os.Environ(), pipeEnv(mailbox, msg)...)
+	cmd.Stdin = stdin
+	stderr := &limitedBuffer{limit: pipeStderrLimit}
+	cmd.Stderr = stderr
+	// Don't wait for children which outlive the command holding its stderr
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	scanner := bufio.NewScanner(bytes.NewReader(stderr.Bytes()))
+	for scanner.Scan() {
+		log.Printf("%s: %s", r.Command, scanner.Text())
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", r.timeout)
+	}
+	return err
+}
+
+// pipeContent returns the standard input of a command: the message verbatim
+// or its HTML part.
+func pipeContent(content StreamContent, raw []byte) (io.Reader, error) {
+	switch content {
+	case StreamContentRFC822:
+		return bytes.NewReader(raw), nil
+	case StreamContentHTML:
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("parse message: %w", err)
+		}
+		html, err := messageMIME(msg, "text/html")
+		if err != nil {
+			return nil, fmt.Errorf("html of message: %w", err)
+		}
+		return bytes.NewReader(html.Body), nil
+	default:
+		return nil, fmt.Errorf("unknown content '%s'", content)
+	}
+}
+
+// pipeEnv returns the environment variables describing msg.
+func pipeEnv(mailbox string, msg *imap.Message) []string {
+	var to []string
+	for _, address := range msg.Envelope.To {
+		to = append(to, address.Address())
+	}
+	return []string{
+		"MAILRULES_MAILBOX=" + mailbox,
+		"MAILRULES_UID=" + strconv.FormatUint(uint64(msg.Uid), 10),
+		"MAILRULES_MESSAGE_ID=" + normalizeMessageID(msg.Envelope.MessageId),
+		"MAILRULES_FROM=" + firstAddress(msg.Envelope.From).Address(),
+		"MAILRULES_TO=" + strings.Join(to, ","),
+		"MAILRULES_SUBJECT=" + strings.ReplaceAll(msg.Envelope.Subject, "\x00", ""),
+		"MAILRULES_DATE=" + messageDate(msg).Format(time.RFC3339),
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it, discarding the
+// rest, so that a chatty command can't exhaust memory.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.limit - b.Len(); n > 0 {
+		b.Buffer.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func (r *PipeRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *PipeRule) fetchItems() []imap.FetchItem {
+	return append(predicateFetchItems(r.Predicate), templateFetchItems(r.Args...)...)
+}
+
+func (r *PipeRule) String() string {
+	s := fmt.Sprintf("if %s then pipe %s \"%s\"", r.Predicate, r.Content, r.Command)
+	if len(r.Args) > 0 {
+		args := make([]string, len(r.Args))
+		for i, arg := range r.Args {
+			args[i] = fmt.Sprintf("\"%s\"", arg)
+		}
+		s += fmt.Sprintf(" args [%s]", strings.Join(args, ", "))
+	}
+	return s
+}
@@ -0,0 +1,170 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// RateHistory records when messages were received, grouped by the value of a
+// field such as the sender, so that bursts of messages can be detected. It is
+// persisted so that the history survives restarts.
+type RateHistory struct {
+	Field string
+	store *Store
+
+	mu sync.Mutex
+	// How long messages are remembered: the longest window of any predicate
+	// using the history, plus a grace period so that bursts received while
+	// the daemon was stopped are still detected.
+	retention time.Duration
+	// Receipt time of each message, by field value and message id.
+	seen map[string]map[string]time.Time
+}
+
+func NewRateHistory(field string, store *Store) (*RateHistory, error) {
+	switch field {
+	case "from", "subject":
+	default:
+		return nil, fmt.Errorf("unknown rate field '%s', expected one of [from, subject]", field)
+	}
+	h := &RateHistory{Field: field, store: store, seen: make(map[string]map[string]time.Time)}
+	if err := store.Load(h.name(), &h.seen); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *RateHistory) name() string {
+	return fmt.Sprintf("rate-%s", h.Field)
+}
+
+// rateHistoryGrace is how long messages are remembered beyond the longest
+// window.
+const rateHistoryGrace = 24 * time.Hour
+
+// retain extends the history to cover window.
+func (h *RateHistory) retain(window time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.retention = max(h.retention, window+rateHistoryGrace)
+}
+
+// key is the value of the field the history is grouped by.
+func (h *RateHistory) key(msg *imap.Message) string {
+	switch h.Field {
+	case "from":
+		return strings.ToLower(firstAddress(msg.Envelope.From).Address())
+	case "subject":
+		return strings.ToLower(baseSubject(msg.Envelope.Subject))
+	}
+	return ""
+}
+
+// record adds msg to the history, unless it was received before the
+// retention period.
+func (h *RateHistory) record(msg *imap.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key, id, received := h.key(msg), h.id(msg), h.received(msg)
+	seen, ok := h.seen[key]
+	if !ok {
+		seen = make(map[string]time.Time)
+		h.seen[key] = seen
+	}
+	if _, ok := seen[id]; !ok && time.Since(received) <= h.retention {
+		seen[id] = received
+		h.prune()
+		h.store.Changed(h.name(), h)
+	}
+}
+
+// count returns the number of messages recorded with the same key as msg
+// received within window before it, including itself.
+func (h *RateHistory) count(msg *imap.Message, window time.Duration) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	received := h.received(msg)
+	n := 0
+	for _, t := range h.seen[h.key(msg)] {
+		if !t.After(received) && received.Sub(t) < window {
+			n++
+		}
+	}
+	return n
+}
+
+func (h *RateHistory) received(msg *imap.Message) time.Time {
+	if msg.InternalDate.IsZero() {
+		return messageDate(msg)
+	}
+	return msg.InternalDate
+}
+
+func (h *RateHistory) id(msg *imap.Message) string {
+	if id := msg.Envelope.MessageId; id != "" {
+		return id
+	}
+	return fmt.Sprintf("%d %s", h.received(msg).UnixNano(), msg.Envelope.Subject)
+}
+
+// prune forgets messages older than the retention period.
+func (h *RateHistory) prune() {
+	for key, seen := range h.seen {
+		for id, t := range seen {
+			if time.Since(t) > h.retention {
+				delete(seen, id)
+			}
+		}
+		if len(seen) == 0 {
+			delete(h.seen, key)
+		}
+	}
+}
+
+func (h *RateHistory) MarshalJSON() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return json.Marshal(h.seen)
+}
+
+// RatePredicate matches messages which arrive in a burst: more (or fewer)
+// than Count messages with the same field value within Window.
+type RatePredicate struct {
+	History    *RateHistory
+	Comparison Comparison
+	Count      int
+	Window     time.Duration
+}
+
+func NewRatePredicate(history *RateHistory, comparison Comparison, count int, window time.Duration) *RatePredicate {
+	history.retain(window)
+	return &RatePredicate{History: history, Comparison: comparison, Count: count, Window: window}
+}
+
+// observe records msg in the history, whether or not the rest of the rule
+// reaches this predicate, so that the rate doesn't depend on the order of
+// rules or the other side of an `and` or `or`.
+func (p *RatePredicate) observe(msg *imap.Message) {
+	p.History.record(msg)
+}
+
+func (p *RatePredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	n := p.History.count(msg, p.Window)
+	if !p.Comparison.compare(int64(n), int64(p.Count)) {
+		return nil, false
+	}
+	log.Printf("Message '%s' is one of %d with the same %s within %s", msg.Envelope.Subject, n, p.History.Field, formatDuration(p.Window))
+	return nil, true
+}
+
+func (p *RatePredicate) String() string {
+	return fmt.Sprintf("%s.rate %s %d per %s", p.History.Field, p.Comparison, p.Count, formatDuration(p.Window))
+}
@@ -0,0 +1,46 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		predicate func(history *RateHistory) Predicate
+		want      bool
+	}{
+		{"alone", func(history *RateHistory) Predicate {
+			return NewRatePredicate(history, GreaterThan, 2, time.Hour)
+		}, true},
+		// Messages the other side of the and rejects still count
+		{"after and", func(history *RateHistory) Predicate {
+			return &AndPredicate{
+				Left:  subjectIs(t, "Ping 3"),
+				Right: NewRatePredicate(history, GreaterThan, 2, time.Hour),
+			}
+		}, true},
+		{"below", func(history *RateHistory) Predicate {
+			return NewRatePredicate(history, GreaterThan, 3, time.Hour)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pings []string
+			for _, subject := range []string{"Ping 1", "Ping 2", "Ping 3"} {
+				pings = append(pings, "From: monitor@example.com\nSubject: "+subject+"\n\nPing\n")
+			}
+			c := testClient(t, pings...)
+			history, err := NewRateHistory("from", NewStore(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			runRules(t, c, NewFlagRule(tt.predicate(history), "Burst"))
+
+			if got := hasFlag(t, c, "Burst"); got != tt.want {
+				t.Errorf("flagged %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// ReceivedChain describes how to read the Received headers of a message.
+type ReceivedChain struct {
+	// TrustedHops is the number of Received headers, from the top, added by
+	// relays internal to the user's mail provider. The first hop after them
+	// records the host which handed the message to the provider.
+	TrustedHops int
+}
+
+// receivedHop is the sending side of a Received header.
+type receivedHop struct {
+	Host string
+	IP   string
+}
+
+var receivedIPPattern = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// hop returns the first untrusted hop of the message's Received chain.
+func (c *ReceivedChain) hop(msg *imap.Message) (receivedHop, bool) {
+	received := messageHeader(msg)["Received"]
+	if len(received) <= c.TrustedHops {
+		return receivedHop{}, false
+	}
+	return parseReceived(received[c.TrustedHops]), true
+}
+
+// parseReceived parses the `from` clause of a Received header, as in
+// `from mta.example.com (mta.example.com [203.0.113.5]) by ...`.
+func parseReceived(received string) receivedHop {
+	var hop receivedHop
+	from := strings.TrimSpace(received)
+	if !strings.HasPrefix(strings.ToLower(from), "from ") {
+		return hop
+	}
+	from = from[len("from "):]
+	if i := strings.Index(strings.ToLower(from), " by "); i >= 0 {
+		from = from[:i]
+	}
+
+	if m := receivedIPPattern.FindStringSubmatch(from); m != nil && net.ParseIP(m[1]) != nil {
+		hop.IP = m[1]
+	}
+
+	// Prefer the name the receiving relay resolved over the name the sender
+	// claimed in its greeting. Either may be fully qualified, with a trailing
+	// dot, as in `mta.example.com.`.
+	helo, comment, _ := strings.Cut(from, "(")
+	for _, word := range strings.Fields(strings.Trim(comment, "()")) {
+		word = strings.TrimSuffix(word, ".")
+		if strings.Contains(word, ".") && !strings.ContainsAny(word, "@[]=") && net.ParseIP(word) == nil {
+			hop.Host = strings.ToLower(word)
+			break
+		}
+	}
+	if hop.Host == "" {
+		if helo = strings.TrimSuffix(strings.TrimSpace(helo), "."); !strings.HasPrefix(helo, "[") && net.ParseIP(helo) == nil {
+			hop.Host = strings.ToLower(helo)
+		}
+	}
+	return hop
+}
+
+// ReceivedPredicate matches the host or address of the first untrusted hop in
+// the message's Received chain, which unlike the From address is recorded by
+// the user's own provider.
+type ReceivedPredicate struct {
+	Field     string
+	Predicate StringPredicate
+	Chain     *ReceivedChain
+}
+
+func NewReceivedPredicate(field string, predicate StringPredicate, chain *ReceivedChain) (*ReceivedPredicate, error) {
+	switch field {
+	case "received.ip", "received.host":
+		return &ReceivedPredicate{Field: field, Predicate: predicate, Chain: chain}, nil
+	default:
+		return nil, fmt.Errorf("unknown field '%s'", field)
+	}
+}
+
+func (p *ReceivedPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	hop, ok := p.Chain.hop(msg)
+	if !ok {
+		return nil, false
+	}
+	value := hop.Host
+	if p.Field == "received.ip" {
+		value = hop.IP
+	}
+	if value == "" {
+		return nil, false
+	}
+	return matchString(p.Predicate, value)
+}
+
+func (p *ReceivedPredicate) fetchItems() []imap.FetchItem {
+	return headerItems()
+}
+
+func (p *ReceivedPredicate) bindings() []string {
+	return stringPredicateBindings(p.Predicate)
+}
+
+func (p *ReceivedPredicate) String() string {
+	return formatStringPredicate(p.Field, p.Predicate)
+}
+
+// NetworkPredicate matches IP addresses within a network.
+type NetworkPredicate struct {
+	*net.IPNet
+}
+
+// NewNetworkPredicate parses a network in CIDR notation, or a single address.
+func NewNetworkPredicate(s string) (*NetworkPredicate, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("malformed IP address '%s'", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &NetworkPredicate{&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed network '%s': %w", s, err)
+	}
+	return &NetworkPredicate{network}, nil
+}
+
+func (p *NetworkPredicate) MatchString(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && p.Contains(ip)
+}
+
+func (p *NetworkPredicate) String() string {
+	if p.IP.To4() == nil {
+		return fmt.Sprintf("in \"%s\"", p.IPNet) // IPv6 networks must be quoted
+	}
+	return fmt.Sprintf("in %s", p.IPNet)
+}
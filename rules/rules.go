@@ -1,18 +1,18 @@
 package rules
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
-	"mime/multipart"
-	"mime/quotedprintable"
 	"net/http"
 	"net/mail"
+	"net/textproto"
+	"net/url"
 	"regexp"
-	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -24,8 +24,20 @@ type Rule interface {
 	Action(ctx context.Context, client *client.Client) error
 }
 
+// DefaultMailbox is the mailbox rules apply to unless they are scoped to
+// another.
+const DefaultMailbox = "INBOX"
+
+// A Block is a group of rules applied to the messages in a mailbox, either
+// when the mailbox changes or, if it has a schedule, on that schedule.
+type Block struct {
+	Mailbox  string
+	Schedule Schedule
+	Rules    []Rule
+}
+
 type Predicate interface {
-	MatchMessage(*imap.Message) bool
+	MatchMessage(*imap.Message) (Bindings, bool)
 }
 
 type AndPredicate struct {
@@ -33,8 +45,52 @@ type AndPredicate struct {
 	Right Predicate
 }
 
-func (p *AndPredicate) MatchMessage(msg *imap.Message) bool {
-	return p.Left.MatchMessage(msg) && p.Right.MatchMessage(msg)
+func (p *AndPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	left, ok := p.Left.MatchMessage(msg)
+	if !ok {
+		return nil, false
+	}
+	right, ok := p.Right.MatchMessage(msg)
+	if !ok {
+		return nil, false
+	}
+	return left.merge(right), true
+}
+
+func (p *AndPredicate) fetchItems() []imap.FetchItem {
+	return append(predicateFetchItems(p.Left), predicateFetchItems(p.Right)...)
+}
+
+// needsBody reports whether the body is needed to decide the conjunction,
+// which it isn't if a side which doesn't need it already fails.
+func (p *AndPredicate) needsBody(msg *imap.Message) bool {
+	left, right := predicateNeedsBody(p.Left, msg), predicateNeedsBody(p.Right, msg)
+	if !left && !right {
+		return false
+	}
+	if !left {
+		_, ok := p.Left.MatchMessage(msg)
+		return ok
+	}
+	if !right {
+		_, ok := p.Right.MatchMessage(msg)
+		return ok
+	}
+	return true
+}
+
+func (p *AndPredicate) loadBody(ctx context.Context, msg *imap.Message, raw []byte) {
+	predicateLoadBody(ctx, p.Left, msg, raw)
+	predicateLoadBody(ctx, p.Right, msg, raw)
+}
+
+func (p *AndPredicate) observe(msg *imap.Message) {
+	predicateObserve(p.Left, msg)
+	predicateObserve(p.Right, msg)
+}
+
+func (p *AndPredicate) bindings() []string {
+	return append(predicateBindings(p.Left), predicateBindings(p.Right)...)
 }
 
 func (p *AndPredicate) String() string {
@@ -50,8 +106,58 @@ func (p *OrPredicate) String() string {
 	return fmt.Sprintf("(%s) or (%s)", p.Left, p.Right)
 }
 
-func (p *OrPredicate) MatchMessage(msg *imap.Message) bool {
-	return p.Left.MatchMessage(msg) || p.Right.MatchMessage(msg)
+func (p *OrPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	if bindings, ok := p.Left.MatchMessage(msg); ok {
+		return bindings, true
+	}
+	return p.Right.MatchMessage(msg)
+}
+
+func (p *OrPredicate) fetchItems() []imap.FetchItem {
+	return append(predicateFetchItems(p.Left), predicateFetchItems(p.Right)...)
+}
+
+// needsBody reports whether the body is needed to decide the disjunction,
+// which it isn't if a side which doesn't need it already matches.
+func (p *OrPredicate) needsBody(msg *imap.Message) bool {
+	left, right := predicateNeedsBody(p.Left, msg), predicateNeedsBody(p.Right, msg)
+	if !left && !right {
+		return false
+	}
+	if !left {
+		_, ok := p.Left.MatchMessage(msg)
+		return !ok
+	}
+	if !right {
+		_, ok := p.Right.MatchMessage(msg)
+		return !ok
+	}
+	return true
+}
+
+func (p *OrPredicate) loadBody(ctx context.Context, msg *imap.Message, raw []byte) {
+	predicateLoadBody(ctx, p.Left, msg, raw)
+	predicateLoadBody(ctx, p.Right, msg, raw)
+}
+
+func (p *OrPredicate) observe(msg *imap.Message) {
+	predicateObserve(p.Left, msg)
+	predicateObserve(p.Right, msg)
+}
+
+// bindings lists the names bound by both sides, as only one side may match.
+func (p *OrPredicate) bindings() []string {
+	right := make(map[string]bool)
+	for _, name := range predicateBindings(p.Right) {
+		right[name] = true
+	}
+	var names []string
+	for _, name := range predicateBindings(p.Left) {
+		if right[name] {
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
 func (p *NotPredicate) String() string {
@@ -62,8 +168,25 @@ type NotPredicate struct {
 	Predicate Predicate
 }
 
-func (p *NotPredicate) MatchMessage(msg *imap.Message) bool {
-	return !p.Predicate.MatchMessage(msg)
+func (p *NotPredicate) fetchItems() []imap.FetchItem {
+	return predicateFetchItems(p.Predicate)
+}
+
+func (p *NotPredicate) needsBody(msg *imap.Message) bool {
+	return predicateNeedsBody(p.Predicate, msg)
+}
+
+func (p *NotPredicate) loadBody(ctx context.Context, msg *imap.Message, raw []byte) {
+	predicateLoadBody(ctx, p.Predicate, msg, raw)
+}
+
+func (p *NotPredicate) observe(msg *imap.Message) {
+	predicateObserve(p.Predicate, msg)
+}
+
+func (p *NotPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	_, ok := p.Predicate.MatchMessage(msg)
+	return nil, !ok
 }
 
 type StringPredicate interface {
@@ -87,79 +210,432 @@ type FieldPredicate struct {
 
 func NewFieldPredicate(field string, predicate StringPredicate) (*FieldPredicate, error) {
 	switch field {
-	case "to", "from", "subject":
+	case "to", "from", "subject", "list.id", "list.post":
 		return &FieldPredicate{Field: field, Predicate: predicate}, nil
 	default:
 		return nil, fmt.Errorf("unknown field '%s'", field)
 	}
 }
 
-func (p *FieldPredicate) MatchMessage(msg *imap.Message) bool {
+func (p *FieldPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
 	switch p.Field {
 	case "to":
 		for _, address := range msg.Envelope.To {
-			if p.Predicate.MatchString(address.Address()) {
-				return true
+			if bindings, ok := p.matchString(address.Address()); ok {
+				return bindings, true
 			}
 		}
 	case "from":
 		for _, address := range msg.Envelope.From {
-			if p.Predicate.MatchString(address.Address()) {
-				return true
+			if bindings, ok := p.matchString(address.Address()); ok {
+				return bindings, true
 			}
 		}
 	case "subject":
-		return p.Predicate.MatchString(msg.Envelope.Subject)
+		return p.matchString(msg.Envelope.Subject)
+	case "list.id":
+		if id := listID(messageHeader(msg)); id != "" {
+			return p.matchString(id)
+		}
+	case "list.post":
+		if address := listPost(messageHeader(msg)); address != "" {
+			return p.matchString(address)
+		}
 	}
-	return false
+	return nil, false
+}
+
+func (p *FieldPredicate) matchString(s string) (Bindings, bool) {
+	return matchString(p.Predicate, s)
+}
+
+func (p *FieldPredicate) fetchItems() []imap.FetchItem {
+	switch p.Field {
+	case "list.id", "list.post":
+		return headerItems()
+	}
+	return nil
+}
+
+func (p *FieldPredicate) bindings() []string {
+	return stringPredicateBindings(p.Predicate)
 }
 
 func (p *FieldPredicate) String() string {
-	switch p.Predicate.(type) {
+	return formatStringPredicate(p.Field, p.Predicate)
+}
+
+// matchString matches s, capturing the groups of regular expressions.
+func matchString(p StringPredicate, s string) (Bindings, bool) {
+	if rexp, ok := p.(*regexp.Regexp); ok {
+		return regexpMatch(rexp, s)
+	}
+	return nil, p.MatchString(s)
+}
+
+func stringPredicateBindings(p StringPredicate) []string {
+	if rexp, ok := p.(*regexp.Regexp); ok {
+		return regexpBindings(rexp)
+	}
+	return nil
+}
+
+func formatStringPredicate(field string, p StringPredicate) string {
+	switch p.(type) {
 	case *regexp.Regexp:
-		return fmt.Sprintf("%s ~ \"%s\"", p.Field, p.Predicate)
+		return fmt.Sprintf("%s ~ \"%s\"", field, p)
+	default:
+		return fmt.Sprintf("%s %s", field, p)
+	}
+}
+
+// Comparison orders a message attribute against a threshold.
+type Comparison string
+
+const (
+	LessThan    Comparison = "<"
+	GreaterThan Comparison = ">"
+)
+
+func (c Comparison) compare(value, threshold int64) bool {
+	switch c {
+	case LessThan:
+		return value < threshold
+	case GreaterThan:
+		return value > threshold
+	}
+	return false
+}
+
+type DurationPredicate struct {
+	Field      string
+	Comparison Comparison
+	Duration   time.Duration
+}
+
+func NewDurationPredicate(field string, comparison Comparison, duration time.Duration) (*DurationPredicate, error) {
+	switch field {
+	case "age":
+		return &DurationPredicate{Field: field, Comparison: comparison, Duration: duration}, nil
 	default:
-		return fmt.Sprintf("%s %s", p.Field, p.Predicate)
+		return nil, fmt.Errorf("unknown duration field '%s'", field)
+	}
+}
+
+func (p *DurationPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	switch p.Field {
+	case "age":
+		received := msg.InternalDate
+		if received.IsZero() {
+			received = msg.Envelope.Date
+		}
+		return nil, p.Comparison.compare(int64(time.Since(received)), int64(p.Duration))
 	}
+	return nil, false
+}
+
+func (p *DurationPredicate) String() string {
+	return fmt.Sprintf("%s %s %s", p.Field, p.Comparison, formatDuration(p.Duration))
+}
+
+// formatDuration formats d in the largest whole unit of the rules language.
+func formatDuration(d time.Duration) string {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+	}
+	for _, u := range units {
+		if d%u.unit == 0 {
+			return fmt.Sprintf("%d%s", d/u.unit, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
 }
 
 type MoveRule struct {
 	Predicate Predicate
-	Mailbox   string
-	messages  *imap.SeqSet
+	Mailbox   *Template
+	messages  map[string]*imap.SeqSet // by destination mailbox
 }
 
-func NewMoveRule(predicate Predicate, mailbox string) *MoveRule {
+func NewMoveRule(predicate Predicate, mailbox string) (*MoveRule, error) {
+	tmpl, err := NewTemplate(mailbox)
+	if err != nil {
+		return nil, err
+	}
 	return &MoveRule{
 		Predicate: predicate,
-		Mailbox:   mailbox,
+		Mailbox:   tmpl,
+		messages:  make(map[string]*imap.SeqSet),
+	}, nil
+}
+
+func (r MoveRule) Message(msg *imap.Message) {
+	bindings, ok := r.Predicate.MatchMessage(msg)
+	if !ok {
+		return
+	}
+	mailbox := r.Mailbox.Expand(msg, bindings)
+	log.Printf("Moving '%s' to '%s'", msg.Envelope.Subject, mailbox)
+	msgs, ok := r.messages[mailbox]
+	if !ok {
+		msgs = new(imap.SeqSet)
+		r.messages[mailbox] = msgs
+	}
+	msgs.AddNum(msg.Uid)
+}
+
+func (r *MoveRule) Action(ctx context.Context, client *client.Client) error {
+	messages := r.messages
+	r.messages = make(map[string]*imap.SeqSet)
+
+	var errs []error
+	for mailbox, msgs := range messages {
+		err := uidMove(client, msgs, mailbox)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("move messages to mailbox `%s`: %w", mailbox, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *MoveRule) checkCapabilities(c *client.Client) error {
+	return checkMove(c)
+}
+
+func (r *MoveRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *MoveRule) fetchItems() []imap.FetchItem {
+	return append(predicateFetchItems(r.Predicate), templateFetchItems(r.Mailbox)...)
+}
+
+func (r *MoveRule) String() string {
+	return fmt.Sprintf("if %s then move \"%s\"", r.Predicate, r.Mailbox)
+}
+
+// CopyRule copies matching messages to another mailbox, leaving them in
+// place. Copies are recorded by Message-ID so that each message is copied
+// to a mailbox once, with the uid of the copy if the server reports it with
+// UIDPLUS, which Copied returns.
+type CopyRule struct {
+	Predicate Predicate
+	Mailbox   *Template
+	messages  map[string]*imap.SeqSet // by destination mailbox
+	keys      map[uint32]string       // ledger key, by message uid
+	ledger    *Ledger
+}
+
+func NewCopyRule(predicate Predicate, mailbox string, env *Environment) (*CopyRule, error) {
+	tmpl, err := NewTemplate(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := env.Store.Ledger("copy")
+	if err != nil {
+		return nil, err
+	}
+	return &CopyRule{
+		Predicate: predicate,
+		Mailbox:   tmpl,
+		messages:  make(map[string]*imap.SeqSet),
+		keys:      make(map[uint32]string),
+		ledger:    ledger,
+	}, nil
+}
+
+func (r CopyRule) Message(msg *imap.Message) {
+	bindings, ok := r.Predicate.MatchMessage(msg)
+	if !ok {
+		return
+	}
+	mailbox := r.Mailbox.Expand(msg, bindings)
+	key := copyKey(mailbox, msg)
+	if r.ledger.Done(key) {
+		return // copied previously
+	}
+	log.Printf("Copying '%s' to '%s'", msg.Envelope.Subject, mailbox)
+	msgs, ok := r.messages[mailbox]
+	if !ok {
+		msgs = new(imap.SeqSet)
+		r.messages[mailbox] = msgs
+	}
+	msgs.AddNum(msg.Uid)
+	r.keys[msg.Uid] = key
+}
+
+// copyKey identifies the copying of msg to mailbox in the ledger.
+func copyKey(mailbox string, msg *imap.Message) string {
+	id := normalizeMessageID(msg.Envelope.MessageId)
+	if id == "" {
+		id = fmt.Sprintf("uid %d", msg.Uid)
+	}
+	return mailbox + " " + id
+}
+
+// Copied returns the uid of the copy of msg in mailbox, if the rule copied
+// it there and the server reported the copy's uid.
+func (r *CopyRule) Copied(mailbox string, msg *imap.Message) (uint32, bool) {
+	note, ok := r.ledger.Note(copyKey(mailbox, msg))
+	if !ok {
+		return 0, false
+	}
+	var uid uint32
+	if _, err := fmt.Sscanf(note, "uid %d", &uid); err != nil {
+		return 0, false
+	}
+	return uid, true
+}
+
+func (r *CopyRule) Action(ctx context.Context, client *client.Client) error {
+	messages := r.messages
+	keys := r.keys
+	r.messages = make(map[string]*imap.SeqSet)
+	r.keys = make(map[uint32]string)
+
+	var errs []error
+	for mailbox, msgs := range messages {
+		copies, err := uidCopy(client, msgs, mailbox)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("copy messages to mailbox `%s`: %w", mailbox, err))
+			continue
+		}
+		for _, uid := range seqSetUIDs(msgs) {
+			var note string
+			if copy, ok := copies[uid]; ok {
+				note = fmt.Sprintf("uid %d", copy)
+			}
+			r.ledger.Record(keys[uid], note)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *CopyRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *CopyRule) fetchItems() []imap.FetchItem {
+	return append(predicateFetchItems(r.Predicate), templateFetchItems(r.Mailbox)...)
+}
+
+func (r *CopyRule) String() string {
+	return fmt.Sprintf("if %s then copy \"%s\"", r.Predicate, r.Mailbox)
+}
+
+// TrashRule moves matching messages to the trash, the mailbox with the
+// SPECIAL-USE attribute \Trash.
+type TrashRule struct {
+	Predicate Predicate
+	messages  *imap.SeqSet
+	trash     string // found by the first action
+}
+
+func NewTrashRule(predicate Predicate) *TrashRule {
+	return &TrashRule{
+		Predicate: predicate,
 		messages:  new(imap.SeqSet),
 	}
 }
 
-func (r MoveRule) Message(msg *imap.Message) {
-	if r.Predicate.MatchMessage(msg) {
-		log.Printf("Moving '%s' to '%s'", msg.Envelope.Subject, r.Mailbox)
+func (r TrashRule) Message(msg *imap.Message) {
+	if _, ok := r.Predicate.MatchMessage(msg); ok {
+		log.Printf("Trashing '%s'", msg.Envelope.Subject)
 		r.messages.AddNum(msg.Uid)
 	}
 }
 
-func (r *MoveRule) Action(ctx context.Context, client *client.Client) error {
+func (r *TrashRule) Action(ctx context.Context, client *client.Client) error {
 	msgs := r.messages
 	r.messages = new(imap.SeqSet)
 	if msgs.Empty() {
 		return nil
 	}
+	if r.trash == "" {
+		trash, err := SpecialUseMailbox(client, imap.TrashAttr)
+		if err != nil {
+			return fmt.Errorf("find trash: %w", err)
+		}
+		r.trash = trash
+	}
+	if mbox := client.Mailbox(); mbox != nil && mbox.Name == r.trash {
+		return nil // already in the trash
+	}
+	if err := uidMove(client, msgs, r.trash); err != nil {
+		return fmt.Errorf("move messages to trash `%s`: %w", r.trash, err)
+	}
+	return nil
+}
 
-	err := client.UidMove(msgs, r.Mailbox)
-	if err != nil {
-		return fmt.Errorf("move messages to mailbox `%s`: %w", r.Mailbox, err)
+func (r *TrashRule) checkCapabilities(c *client.Client) error {
+	return checkMove(c)
+}
+
+func (r *TrashRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *TrashRule) fetchItems() []imap.FetchItem {
+	return predicateFetchItems(r.Predicate)
+}
+
+func (r *TrashRule) String() string {
+	return fmt.Sprintf("if %s then trash", r.Predicate)
+}
+
+// DeleteRule permanently deletes matching messages. Only the matching
+// messages are expunged, so the rule requires a server supporting UIDPLUS.
+type DeleteRule struct {
+	Predicate Predicate
+	messages  *imap.SeqSet
+}
+
+func NewDeleteRule(predicate Predicate) *DeleteRule {
+	return &DeleteRule{
+		Predicate: predicate,
+		messages:  new(imap.SeqSet),
+	}
+}
+
+func (r DeleteRule) Message(msg *imap.Message) {
+	if _, ok := r.Predicate.MatchMessage(msg); ok {
+		log.Printf("Deleting '%s'", msg.Envelope.Subject)
+		r.messages.AddNum(msg.Uid)
+	}
+}
+
+func (r *DeleteRule) Action(ctx context.Context, client *client.Client) error {
+	msgs := r.messages
+	r.messages = new(imap.SeqSet)
+	if msgs.Empty() {
+		return nil
+	}
+	if err := uidDelete(client, msgs); err != nil {
+		return fmt.Errorf("delete messages: %w", err)
 	}
 	return nil
 }
 
-func (r *MoveRule) String() string {
-	return fmt.Sprintf("if %s then move \"%s\"", r.Predicate, r.Mailbox)
+func (r *DeleteRule) checkCapabilities(c *client.Client) error {
+	return checkDelete(c)
+}
+
+func (r *DeleteRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *DeleteRule) fetchItems() []imap.FetchItem {
+	return predicateFetchItems(r.Predicate)
+}
+
+func (r *DeleteRule) String() string {
+	return fmt.Sprintf("if %s then delete confirm", r.Predicate)
 }
 
 type FlagRule struct {
@@ -185,7 +661,7 @@ func (r FlagRule) Message(msg *imap.Message) {
 			return // already flagged
 		}
 	}
-	if r.Predicate.MatchMessage(msg) {
+	if _, ok := r.Predicate.MatchMessage(msg); ok {
 		log.Printf("Flagging message '%s' with '%s'", msg.Envelope.Subject, r.Flag)
 		r.messages.AddNum(msg.Uid)
 	}
@@ -206,6 +682,14 @@ func (r *FlagRule) Action(ctx context.Context, client *client.Client) error {
 	return nil
 }
 
+func (r *FlagRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *FlagRule) fetchItems() []imap.FetchItem {
+	return predicateFetchItems(r.Predicate)
+}
+
 func (r *FlagRule) String() string {
 	return fmt.Sprintf("if %s then flag \"%s\"", r.Predicate, r.Flag)
 }
@@ -233,7 +717,7 @@ func (r UnflagRule) Message(msg *imap.Message) {
 			return // already flagged
 		}
 	}
-	if r.Predicate.MatchMessage(msg) {
+	if _, ok := r.Predicate.MatchMessage(msg); ok {
 		log.Printf("Unflagging message '%s' with '%s'", msg.Envelope.Subject, r.Flag)
 		r.messages.AddNum(msg.Uid)
 	}
@@ -254,6 +738,14 @@ func (r *UnflagRule) Action(ctx context.Context, client *client.Client) error {
 	return nil
 }
 
+func (r *UnflagRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *UnflagRule) fetchItems() []imap.FetchItem {
+	return predicateFetchItems(r.Predicate)
+}
+
 func (r *UnflagRule) String() string {
 	return fmt.Sprintf("if %s then unflag \"%s\"", r.Predicate, r.Flag)
 }
@@ -261,8 +753,9 @@ func (r *UnflagRule) String() string {
 type StreamRule struct {
 	Predicate Predicate
 	Content   StreamContent
-	URL       string
+	URL       *Template
 	messages  *imap.SeqSet
+	urls      map[uint32]string // by message uid
 	done      *imap.SeqSet
 	client    *http.Client
 }
@@ -274,24 +767,45 @@ const (
 	StreamContentRFC822 StreamContent = "rfc822"
 )
 
-func NewStreamRule(predicate Predicate, content string, url string) *StreamRule {
+// parseStreamContent validates the form in which a message is posted.
+func parseStreamContent(content string) (StreamContent, error) {
+	switch c := StreamContent(content); c {
+	case StreamContentHTML, StreamContentRFC822:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown content '%s', expected one of [%s, %s]", content, StreamContentRFC822, StreamContentHTML)
+	}
+}
+
+func NewStreamRule(predicate Predicate, content string, url string, env *Environment) (*StreamRule, error) {
+	c, err := parseStreamContent(content)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := NewTemplate(url)
+	if err != nil {
+		return nil, err
+	}
 	return &StreamRule{
 		Predicate: predicate,
-		Content:   StreamContent(content),
-		URL:       url,
+		Content:   c,
+		URL:       tmpl,
 		messages:  new(imap.SeqSet),
+		urls:      make(map[uint32]string),
 		done:      new(imap.SeqSet), // this rule has processed this message previously
-		client:    http.DefaultClient,
-	}
+		client:    env.httpClient(),
+	}, nil
 }
 
 func (r StreamRule) Message(msg *imap.Message) {
 	if r.done.Contains(msg.Uid) {
 		return
 	}
-	if r.Predicate.MatchMessage(msg) {
-		log.Printf("Streaming '%s' to '%s'", msg.Envelope.Subject, r.URL)
+	if bindings, ok := r.Predicate.MatchMessage(msg); ok {
+		target := r.URL.expand(msg, bindings, url.PathEscape)
+		log.Printf("Streaming '%s' to '%s'", msg.Envelope.Subject, target)
 		r.messages.AddNum(msg.Uid)
+		r.urls[msg.Uid] = target
 	}
 }
 
@@ -301,99 +815,107 @@ const (
 
 func (r *StreamRule) Action(ctx context.Context, client *client.Client) error {
 	msgs := r.messages
+	urls := r.urls
 	r.messages = new(imap.SeqSet)
+	r.urls = make(map[uint32]string)
 	r.done.AddSet(msgs)
 	if msgs.Empty() {
 		return nil
 	}
 
-	messages := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
-	go func() {
-		done <- client.UidFetch(msgs, []imap.FetchItem{imap.FetchUid, "BODY[]"}, messages)
-	}()
-
-	for message := range messages {
-		err := r.handleMessage(ctx, message)
+	err := fetchBodies(client, msgs, func(message *imap.Message, raw []byte) {
+		err := r.handleMessage(ctx, raw, urls[message.Uid])
 		if err != nil {
-			log.Printf("stream message `%s` to `%s`: %v", message.Envelope.Subject, r.URL, err)
+			log.Printf("stream message %d to `%s`: %v", message.Uid, urls[message.Uid], err)
 		}
-	}
-
-	if err := <-done; err != nil {
+	})
+	if err != nil {
 		return fmt.Errorf("stream messages to `%s`: %w", r.URL, err)
 	}
 
 	return nil
 }
 
-func (r *StreamRule) handleMessage(ctx context.Context, message *imap.Message) error {
-	var rfc822 io.Reader
-	for _, v := range message.Body {
-		if v == nil {
-			continue
-		}
-		rfc822 = v
+func (r *StreamRule) handleMessage(ctx context.Context, raw []byte, url string) error {
+	if raw == nil {
+		return fmt.Errorf("stream messages to `%s`: body not fetched", url)
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	switch r.Content {
+	req, err := newContentRequest(ctx, r.Content, url, bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("stream messages to `%s`: %w", url, err)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("stream messages to `%s`: do http request: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("stream messages to `%s`: error response: %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// newContentRequest constructs the request posting the message, read from
+// rfc822, to url in the form given by content.
+func newContentRequest(ctx context.Context, content StreamContent, url string, rfc822 io.Reader) (*http.Request, error) {
+	switch content {
 	case StreamContentRFC822:
 		// Pass the email to the command verbatim
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, rfc822)
-		req.Header.Set("Content-Type", "message/rfc822")
-		req.Header.Set("Accept", "application/json")
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, rfc822)
 		if err != nil {
-			return fmt.Errorf("stream messages to `%s`: construct post request: %w", r.URL, err)
-		}
-		resp, err := r.client.Do(req)
-		if err != nil {
-			return fmt.Errorf("stream messages to `%s`: do http request: %w", r.URL, err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode < 200 && resp.StatusCode >= 300 {
-			return fmt.Errorf("stream messages to `%s`: error response: %d", r.URL, resp.StatusCode)
+			return nil, fmt.Errorf("construct post request: %w", err)
 		}
+		req.Header.Set("Content-Type", "message/rfc822")
+		req.Header.Set("Accept", "application/json")
+		return req, nil
 	case StreamContentHTML:
 		// Parse the email and find the HTML to pass to the command
 		msg, err := mail.ReadMessage(rfc822)
 		if err != nil {
-			return fmt.Errorf("parse message: %w", err)
+			return nil, fmt.Errorf("parse message: %w", err)
 		}
 		html, err := messageMIME(msg, "text/html")
 		if err != nil {
-			return fmt.Errorf("html of message %d: %w", message.Uid, err)
+			return nil, fmt.Errorf("html of message: %w", err)
 		}
 		date, err := msg.Header.Date()
 		if err != nil {
-			return fmt.Errorf("parse date of message %d: %w", message.Uid, err)
+			return nil, fmt.Errorf("parse date of message: %w", err)
 		}
 		dec := new(mime.WordDecoder)
 		subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
 		if err != nil {
-			return fmt.Errorf("decode subject of message %d: %w", message.Uid, err)
+			return nil, fmt.Errorf("decode subject of message: %w", err)
 		}
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, html)
-		req.Header.Set("Content-Type", "message/rfc822")
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(html.Body))
+		if err != nil {
+			return nil, fmt.Errorf("construct post request: %w", err)
+		}
+		contentType := "text/html"
+		if charset := html.Params["charset"]; charset != "" {
+			contentType = mime.FormatMediaType(contentType, map[string]string{"charset": charset})
+		}
+		req.Header.Set("Content-Type", contentType)
 		req.Header.Set("Accept", "application/json")
 		req.Header.Set("X-Message-UUID", msg.Header.Get("X-Apple-UUID"))
 		req.Header.Set("X-Message-Subject", subject)
 		req.Header.Set("X-Message-Date-RFC3339", date.Format(time.RFC3339))
 		req.Header.Set("X-Message-Date-RFC2822", date.Format(RFC2822))
-		if err != nil {
-			return fmt.Errorf("stream messages to `%s`: construct post request: %w", r.URL, err)
-		}
-		resp, err := r.client.Do(req)
-		if err != nil {
-			return fmt.Errorf("stream messages to `%s`: do http request: %w", r.URL, err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode < 200 && resp.StatusCode >= 300 {
-			return fmt.Errorf("stream messages to `%s`: error response: %d", r.URL, resp.StatusCode)
-		}
+		return req, nil
+	default:
+		return nil, fmt.Errorf("unknown content '%s'", content)
 	}
-	return nil
+}
+
+func (r *StreamRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *StreamRule) fetchItems() []imap.FetchItem {
+	return append(predicateFetchItems(r.Predicate), templateFetchItems(r.URL)...)
 }
 
 func (r *StreamRule) String() string {
@@ -401,37 +923,18 @@ func (r *StreamRule) String() string {
 }
 
 // Find and parse part of message
-func messageMIME(message *mail.Message, contentType string) (io.Reader, error) {
-	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+func messageMIME(message *mail.Message, contentType string) (*messagePart, error) {
+	var found *messagePart
+	err := walkParts(textproto.MIMEHeader(message.Header), message.Body, func(part messagePart) {
+		if found == nil && part.MediaType == contentType {
+			found = &part
+		}
+	})
 	if err != nil {
-		return nil, fmt.Errorf("parse message content type: %w", err)
+		return nil, err
 	}
-	if !strings.HasPrefix(mediaType, "multipart/") {
-		return nil, fmt.Errorf("expected multipart message but found %s", mediaType)
-	}
-	reader := multipart.NewReader(message.Body, params["boundary"])
-	if reader == nil {
-		return nil, fmt.Errorf("could not construct multipart reader for message")
-	}
-	for {
-		part, err := reader.NextPart()
-		if err != nil {
-			return nil, fmt.Errorf("could not find %s part of message: %w", contentType, err)
-		}
-		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		if err != nil {
-			return nil, fmt.Errorf("parse multipart message part content type: %w", err)
-		}
-		if mediaType == contentType {
-			enc := strings.ToLower(part.Header.Get("Content-Transfer-Encoding"))
-			switch enc {
-			case "base64":
-				return base64.NewDecoder(base64.StdEncoding, part), nil
-			case "quoted-printable":
-				return quotedprintable.NewReader(part), nil
-			default:
-				return part, nil
-			}
-		}
+	if found == nil {
+		return nil, fmt.Errorf("could not find %s part of message", contentType)
 	}
+	return found, nil
 }
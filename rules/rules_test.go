@@ -0,0 +1,138 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// testClient connects to an in-memory IMAP server and selects its INBOX,
+// which holds the messages given, in addition to one from the backend.
+func testClient(t *testing.T, messages ...string) *client.Client {
+	t.Helper()
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		msg = strings.ReplaceAll(msg, "\n", "\r\n")
+		if err := c.Append("INBOX", nil, time.Now(), strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// runRules applies the rules to the selected mailbox once, as the daemon
+// does whenever it changes.
+func runRules(t *testing.T, c *client.Client, rs ...Rule) {
+	t.Helper()
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, FetchItems(rs), messages)
+	}()
+	var held []*imap.Message
+	for msg := range messages {
+		Observe(rs, msg)
+		if NeedsBody(rs, msg) {
+			held = append(held, msg)
+			continue
+		}
+		for _, rule := range rs {
+			rule.Message(msg)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadBodies(context.Background(), c, rs, held); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range held {
+		for _, rule := range rs {
+			if Undecided(rule, msg) {
+				continue
+			}
+			rule.Message(msg)
+		}
+	}
+	for _, rule := range rs {
+		if err := rule.Action(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// subjectIs matches messages with the subject given.
+func subjectIs(t *testing.T, subject string) Predicate {
+	t.Helper()
+	p, err := NewFieldPredicate("subject", StringEqualsPredicate(subject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		caps     string
+		commands []string // sent to delete the messages
+		err      error
+	}{
+		{"uidplus", "IMAP4rev1 UIDPLUS", []string{`UID STORE 2:3 +FLAGS.SILENT (\Deleted)`, "UID EXPUNGE 2:3"}, nil},
+		// EXPUNGE would also remove any other message marked \Deleted
+		{"no uidplus", "IMAP4rev1", nil, errNoUIDPlus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scriptedServer{caps: tt.caps}
+			c := newScriptedClient(t, s)
+			rule := NewDeleteRule(&NotPredicate{Predicate: &BulkPredicate{}})
+			if err := CheckCapabilities(c, []Rule{rule}); !errors.Is(err, tt.err) {
+				t.Errorf("got capability error %v, want %v", err, tt.err)
+			}
+			for _, uid := range []uint32{2, 3} {
+				rule.Message(&imap.Message{Uid: uid, Envelope: &imap.Envelope{}})
+			}
+			if err := rule.Action(context.Background(), c); !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+
+			got := append(s.sent("UID STORE"), s.sent("UID EXPUNGE")...)
+			if strings.Join(got, "\n") != strings.Join(tt.commands, "\n") {
+				t.Errorf("sent %q, want %q", got, tt.commands)
+			}
+			if got := s.sent("EXPUNGE"); len(got) > 0 {
+				t.Errorf("sent %q, which expunges every message marked \\Deleted", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,486 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// SaveFormat is the form in which messages are saved to the filesystem.
+type SaveFormat string
+
+const (
+	// SaveMaildir delivers messages to the new directory of a Maildir.
+	SaveMaildir SaveFormat = "maildir"
+	// SaveMbox appends messages to an mbox file, quoting From lines as in
+	// mboxrd.
+	SaveMbox SaveFormat = "mbox"
+	// SaveEML writes each message to its own file in a directory, named by
+	// its Message-ID.
+	SaveEML SaveFormat = "eml"
+	// SaveAttachments writes the attachments of each message to files in a
+	// directory, each with a JSON sidecar describing the message.
+	SaveAttachments SaveFormat = "attachments"
+)
+
+// SaveRule saves matching messages to the local filesystem. Each message is
+// saved at most once to each path, which is recorded in the "save" ledger so
+// that it isn't saved again after a restart, and is written atomically so
+// that a reader never sees part of a message.
+type SaveRule struct {
+	Predicate Predicate
+	Format    SaveFormat
+	Path      *Template
+	// Matching selects the attachments saved by their file names, if the
+	// format is SaveAttachments. Every attachment is saved if it is nil.
+	Matching *regexp.Regexp
+	messages *imap.SeqSet
+	targets  map[uint32]saveTarget // by message uid
+	ledger   *Ledger
+}
+
+type saveTarget struct {
+	path     string
+	key      string // ledger key
+	received time.Time
+}
+
+// mboxes serializes appends to each mbox file, which may be shared by rules.
+var mboxes sync.Map // map[string]*sync.Mutex
+
+func NewSaveRule(predicate Predicate, format string, path string, matching *regexp.Regexp, env *Environment) (*SaveRule, error) {
+	switch SaveFormat(format) {
+	case SaveMaildir, SaveMbox, SaveEML, SaveAttachments:
+	default:
+		return nil, fmt.Errorf("unknown save format '%s', expected one of [%s, %s, %s, %s]", format, SaveMaildir, SaveMbox, SaveEML, SaveAttachments)
+	}
+	if matching != nil && SaveFormat(format) != SaveAttachments {
+		return nil, fmt.Errorf("only attachments are selected by 'matching', not messages saved as %s", format)
+	}
+	tmpl, err := NewTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := env.Store.Ledger("save")
+	if err != nil {
+		return nil, err
+	}
+	return &SaveRule{
+		Predicate: predicate,
+		Format:    SaveFormat(format),
+		Path:      tmpl,
+		Matching:  matching,
+		messages:  new(imap.SeqSet),
+		targets:   make(map[uint32]saveTarget),
+		ledger:    ledger,
+	}, nil
+}
+
+func (r SaveRule) Message(msg *imap.Message) {
+	bindings, ok := r.Predicate.MatchMessage(msg)
+	if !ok {
+		return
+	}
+	path := filepath.Clean(r.Path.expand(msg, bindings, pathSegment))
+	id := normalizeMessageID(msg.Envelope.MessageId)
+	if id == "" {
+		id = fmt.Sprintf("uid %d", msg.Uid)
+	}
+	key := fmt.Sprintf("%s %s %s", r.Format, path, id)
+	if r.ledger.Done(key) {
+		return // saved previously
+	}
+	log.Printf("Saving '%s' to %s '%s'", msg.Envelope.Subject, r.Format, path)
+	r.messages.AddNum(msg.Uid)
+	r.targets[msg.Uid] = saveTarget{path: path, key: key, received: msg.InternalDate}
+}
+
+func (r *SaveRule) Action(ctx context.Context, client *client.Client) error {
+	msgs := r.messages
+	targets := r.targets
+	r.messages = new(imap.SeqSet)
+	r.targets = make(map[uint32]saveTarget)
+	if msgs.Empty() {
+		return nil
+	}
+
+	var mailbox string
+	var uidValidity uint32
+	if status := client.Mailbox(); status != nil {
+		mailbox, uidValidity = status.Name, status.UidValidity
+	}
+	var errs []error
+	err := fetchBodies(client, msgs, func(msg *imap.Message, raw []byte) {
+		target := targets[msg.Uid]
+		if raw == nil {
+			errs = append(errs, fmt.Errorf("save message %d: body not fetched", msg.Uid))
+			return
+		}
+		var file string
+		var err error
+		switch r.Format {
+		case SaveMaildir:
+			file, err = saveMaildir(target.path, raw)
+		case SaveMbox:
+			file, err = target.path, saveMbox(target.path, msg, target.received, raw)
+		case SaveEML:
+			file, err = saveEML(target.path, msg, raw)
+		case SaveAttachments:
+			file, err = r.saveAttachments(target.path, mailbox, uidValidity, msg, raw)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("save message %d to %s `%s`: %w", msg.Uid, r.Format, target.path, err))
+			return
+		}
+		r.ledger.Record(target.key, file)
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("save messages: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// saveMaildir delivers raw to the Maildir dir, creating it if need be, by
+// writing it to tmp and then moving it to new.
+func saveMaildir(dir string, raw []byte) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return "", err
+		}
+	}
+	name, err := maildirName()
+	if err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := writeFileSync(tmp, raw); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	file := filepath.Join(dir, "new", name)
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return file, nil
+}
+
+// maildirName returns a unique name for a message delivered to a Maildir.
+func maildirName() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// Slashes and colons are reserved in Maildir names
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), hex.EncodeToString(random), host), nil
+}
+
+// saveMbox appends raw to the mbox file, creating it if need be. A failed
+// append is truncated so as not to leave part of a message.
+func saveMbox(file string, msg *imap.Message, received time.Time, raw []byte) error {
+	mu, _ := mboxes.LoadOrStore(file, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(mboxEntry(msg, received, raw)); err != nil {
+		f.Truncate(info.Size())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
+
+// mboxEntry formats raw as an mboxrd entry: a From line giving the sender
+// and date, the message with LF line endings and its From lines quoted, and
+// a blank line.
+func mboxEntry(msg *imap.Message, received time.Time, raw []byte) []byte {
+	sender := "MAILER-DAEMON"
+	for _, addresses := range [][]*imap.Address{msg.Envelope.Sender, msg.Envelope.From} {
+		// Address joins the parts with @ even if both are missing
+		if address := firstAddress(addresses); address.MailboxName != "" && address.HostName != "" {
+			sender = address.Address()
+			break
+		}
+	}
+	if received.IsZero() {
+		received = messageDate(msg)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", sender, received.UTC().Format(time.ANSIC))
+	lines := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteByte('>')
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// saveEML writes raw to a file in dir named by the message's Message-ID, or
+// its date and UID if it has none, unless the file already exists.
+func saveEML(dir string, msg *imap.Message, raw []byte) (string, error) {
+	name := pathSegment(normalizeMessageID(msg.Envelope.MessageId))
+	if name == "" || name == "_" {
+		name = fmt.Sprintf("%s-%d", messageDate(msg).UTC().Format("20060102T150405Z"), msg.Uid)
+	}
+	file := filepath.Join(dir, name+".eml")
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return file, writeFileAtomic(file, raw)
+}
+
+// attachmentSidecar is the JSON file written alongside each saved
+// attachment, describing it and the message it was attached to.
+type attachmentSidecar struct {
+	// Filename is the name of the attachment in the message, before it was
+	// made safe to save.
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+
+	Mailbox     string           `json:"mailbox"`
+	UID         uint32           `json:"uid"`
+	UIDValidity uint32           `json:"uidvalidity"`
+	MessageID   string           `json:"message_id"`
+	Date        time.Time        `json:"date"`
+	Subject     string           `json:"subject"`
+	From        []webhookAddress `json:"from"`
+	To          []webhookAddress `json:"to"`
+}
+
+// saveAttachments writes the attachments of msg matching r.Matching to files
+// in dir, returning their names separated by commas. An attachment is saved
+// once however many messages it is attached to, by the hash of its content.
+func (r *SaveRule) saveAttachments(dir string, mailbox string, uidValidity uint32, msg *imap.Message, raw []byte) (string, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", fmt.Errorf("parse message: %w", err)
+	}
+	var attachments []messagePart
+	err = walkParts(textproto.MIMEHeader(m.Header), m.Body, func(part messagePart) {
+		if isAttachment(part) && (r.Matching == nil || r.Matching.MatchString(part.Filename)) {
+			attachments = append(attachments, part)
+		}
+	})
+	if err != nil {
+		return "", fmt.Errorf("parse message: %w", err)
+	}
+	if len(attachments) == 0 {
+		return "", nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	var files []string
+	for _, part := range attachments {
+		sum := sha256.Sum256(part.Body)
+		hash := hex.EncodeToString(sum[:])
+		key := fmt.Sprintf("%s %s sha256:%s", SaveAttachments, dir, hash)
+		if r.ledger.Done(key) {
+			continue // saved from another message
+		}
+		file, err := attachmentFile(dir, part, hash)
+		if err != nil {
+			return "", err
+		}
+		sidecar, err := json.MarshalIndent(attachmentSidecar{
+			Filename:    part.Filename,
+			ContentType: part.MediaType,
+			Size:        len(part.Body),
+			SHA256:      hash,
+			Mailbox:     mailbox,
+			UID:         msg.Uid,
+			UIDValidity: uidValidity,
+			MessageID:   normalizeMessageID(msg.Envelope.MessageId),
+			Date:        messageDate(msg),
+			Subject:     msg.Envelope.Subject,
+			From:        webhookAddresses(msg.Envelope.From),
+			To:          webhookAddresses(msg.Envelope.To),
+		}, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(file+".json", sidecar); err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(file, part.Body); err != nil {
+			return "", err
+		}
+		r.ledger.Record(key, file)
+		files = append(files, file)
+	}
+	return strings.Join(files, ","), nil
+}
+
+// attachmentFile returns the file in dir to save part to: its file name,
+// made safe, or with a prefix of hash if another file has the name.
+func attachmentFile(dir string, part messagePart, hash string) (string, error) {
+	name := attachmentName(part)
+	file := filepath.Join(dir, name)
+	existing, err := os.ReadFile(file)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return file, nil
+	case err != nil:
+		return "", err
+	case bytes.Equal(existing, part.Body):
+		return file, nil // saved before its hash was recorded
+	}
+	ext := filepath.Ext(name)
+	return filepath.Join(dir, fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), hash[:12], ext)), nil
+}
+
+// maxFilename is the longest file name most filesystems allow, in bytes.
+const maxFilename = 255
+
+// attachmentName returns the file name of part, made safe to save: without
+// directories, control characters or a leading dot, and short enough for
+// the filesystem and its sidecar's suffix.
+func attachmentName(part messagePart) string {
+	name := part.Filename
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < ' ', r == 0x7f, strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, strings.ToValidUTF8(name, "_"))
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		name = "attachment"
+		if exts, err := mime.ExtensionsByType(part.MediaType); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	// Leave room for the hash prefix and the sidecar's extension
+	limit := maxFilename - len(ext) - len("-123456789012.json")
+	base := strings.TrimSuffix(name, ext)
+	for len(base) > limit {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
+	}
+	return base + ext
+}
+
+// writeFileAtomic writes buf to file by way of a temporary file in the same
+// directory, so that file is never seen incomplete.
+func writeFileAtomic(file string, buf []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(file), ".*.tmp")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := writeFileSync(f.Name(), buf); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// writeFileSync writes buf to file and flushes it to disk, so that it can
+// then be renamed into place.
+func writeFileSync(file string, buf []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pathSegment escapes a value substituted into a path, so that it names a
+// single file or directory rather than escaping the directory it is in.
+func pathSegment(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 || r < ' ' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+func (r *SaveRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *SaveRule) fetchItems() []imap.FetchItem {
+	return append(predicateFetchItems(r.Predicate), templateFetchItems(r.Path)...)
+}
+
+func (r *SaveRule) String() string {
+	if r.Matching != nil {
+		return fmt.Sprintf("if %s then save %s \"%s\" matching \"%s\"", r.Predicate, r.Format, r.Path, r.Matching)
+	}
+	return fmt.Sprintf("if %s then save %s \"%s\"", r.Predicate, r.Format, r.Path)
+}
@@ -0,0 +1,279 @@
+package rules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// report has no Message-ID, and lines beginning "From " which mbox quotes.
+const report = `From: Bob <bob@example.com>
+To: me@example.com
+Subject: Report
+Date: Mon, 02 Mar 2026 10:00:00 +0000
+Content-Type: text/plain; charset=utf-8
+
+From the desk of Bob:
+>From last week, unchanged.
+`
+
+// savedFiles returns the contents of the files matching pattern in dir, in
+// the order of their names.
+func savedFiles(t *testing.T, dir string, pattern string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	var contents []string
+	for _, file := range files {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(buf))
+	}
+	return contents
+}
+
+func TestSave(t *testing.T) {
+	tests := []struct {
+		format SaveFormat
+		path   string
+		files  map[string][]string // contents of the files matching each pattern
+	}{
+		{SaveMaildir, "Mail/{{from.domain}}", map[string][]string{
+			"Mail/example.com/new/*": {crlf(invoice), crlf(report)},
+			"Mail/example.com/tmp/*": nil,
+		}},
+		{SaveMbox, "mail/{{from.domain}}.mbox", map[string][]string{
+			"mail/example.com.mbox": {
+				"From alice@example.com $DATE\n" + invoice + "\n" +
+					"From bob@example.com $DATE\n" + strings.NewReplacer("\nFrom ", "\n>From ", "\n>From ", "\n>>From ").Replace(report) + "\n",
+			},
+		}},
+		{SaveEML, "eml/{{from.user}}", map[string][]string{
+			"eml/alice/*":                       {crlf(invoice)},
+			"eml/alice/invoice@example.com.eml": {crlf(invoice)},
+			"eml/bob/20260302T100000Z-*.eml":    {crlf(report)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			dir := t.TempDir()
+			env := &Environment{Store: NewStore("")}
+			c := testClient(t, invoice, report)
+			rule, err := NewSaveRule(fieldMatches(t, "from", "@example.com$"), string(tt.format), filepath.Join(dir, tt.path), nil, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runRules(t, c, rule)
+			// Saved messages are recorded, by this and any other rule
+			runRules(t, c, rule)
+			again, err := NewSaveRule(fieldMatches(t, "from", "@example.com$"), string(tt.format), filepath.Join(dir, tt.path), nil, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runRules(t, c, again)
+
+			for pattern, want := range tt.files {
+				got := savedFiles(t, dir, pattern)
+				if len(got) != len(want) {
+					t.Errorf("saved %d files matching %s, want %d", len(got), pattern, len(want))
+					continue
+				}
+				for i := range want {
+					if strings.Contains(want[i], "$DATE") {
+						// Messages are received as the test appends them
+						got[i] = regexp.MustCompile(`(?m)^(From \S+) .*$`).ReplaceAllString(got[i], "$1 $$DATE")
+					}
+					if got[i] != want[i] {
+						t.Errorf("saved %s\n%q\nwant\n%q", pattern, got[i], want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMboxEntry(t *testing.T) {
+	received := time.Date(2026, time.March, 2, 9, 0, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		envelope *imap.Envelope
+		received time.Time
+		raw      string
+		want     string
+	}{
+		{
+			name:     "sender",
+			envelope: &imap.Envelope{Sender: []*imap.Address{{MailboxName: "bounces", HostName: "example.com"}}, From: []*imap.Address{{MailboxName: "alice", HostName: "example.com"}}},
+			received: received,
+			raw:      "Subject: Hi\r\n\r\nHello\r\n",
+			want:     "From bounces@example.com Mon Mar  2 09:00:05 2026\nSubject: Hi\n\nHello\n\n",
+		},
+		{
+			name:     "from",
+			envelope: &imap.Envelope{From: []*imap.Address{{MailboxName: "alice", HostName: "example.com"}}},
+			received: received,
+			raw:      "Subject: Hi\r\n\r\nHello",
+			want:     "From alice@example.com Mon Mar  2 09:00:05 2026\nSubject: Hi\n\nHello\n\n",
+		},
+		{
+			name:     "no sender",
+			envelope: &imap.Envelope{From: []*imap.Address{{PersonalName: "Undisclosed"}}},
+			received: received,
+			raw:      "Subject: Hi\r\n\r\nHello\r\n",
+			want:     "From MAILER-DAEMON Mon Mar  2 09:00:05 2026\nSubject: Hi\n\nHello\n\n",
+		},
+		{
+			name:     "date",
+			envelope: &imap.Envelope{Date: received.Add(-time.Hour), From: []*imap.Address{{MailboxName: "alice", HostName: "example.com"}}},
+			raw:      "Subject: Hi\r\n\r\nHello\r\n",
+			want:     "From alice@example.com Mon Mar  2 08:00:05 2026\nSubject: Hi\n\nHello\n\n",
+		},
+		{
+			name:     "from lines",
+			envelope: &imap.Envelope{From: []*imap.Address{{MailboxName: "alice", HostName: "example.com"}}},
+			received: received,
+			raw:      "Subject: Hi\r\n\r\nFrom here\r\n>From there\r\nFromage\r\n",
+			want:     "From alice@example.com Mon Mar  2 09:00:05 2026\nSubject: Hi\n\n>From here\n>>From there\nFromage\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(mboxEntry(&imap.Message{Envelope: tt.envelope}, tt.received, []byte(tt.raw)))
+			if got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// statement builds a message from Acme with an attachment named statement.pdf
+// holding pdf, and a logo.
+func statement(id string, pdf string) string {
+	return `From: Acme Billing <billing@acme.example>
+To: me@example.com
+Subject: Statement
+Date: Mon, 02 Mar 2026 09:00:00 +0000
+Message-ID: <` + id + `>
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary=b
+
+--b
+Content-Type: text/plain; charset=utf-8
+
+Your statement is attached.
+--b
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="statement.pdf"
+
+` + pdf + `
+--b
+Content-Type: image/png
+Content-Disposition: inline; filename="logo.png"
+
+PNG
+--b--
+`
+}
+
+func TestSaveAttachments(t *testing.T) {
+	dir := t.TempDir()
+	env := &Environment{Store: NewStore("")}
+	c := testClient(t,
+		statement("march@acme.example", "%PDF march"),
+		// The same statement again, which isn't saved twice
+		statement("march-resent@acme.example", "%PDF march"),
+		// Another with the same name, which is saved under its hash
+		statement("april@acme.example", "%PDF april"),
+	)
+	rule, err := NewSaveRule(fieldMatches(t, "from", "@acme.example$"), "attachments", filepath.Join(dir, "{{from.domain}}"), regexp.MustCompile(`\.pdf$`), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runRules(t, c, rule)
+	runRules(t, c, rule)
+
+	files, err := filepath.Glob(filepath.Join(dir, "acme.example", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	aprilSum := sha256.Sum256([]byte("%PDF april"))
+	april := "statement-" + hex.EncodeToString(aprilSum[:])[:12] + ".pdf"
+	want := []string{april, april + ".json", "statement.pdf", "statement.pdf.json"}
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Fatalf("saved %q, want %q", files, want)
+	}
+	for name, content := range map[string]string{"statement.pdf": "%PDF march", april: "%PDF april"} {
+		if got := savedFiles(t, dir, filepath.Join("acme.example", name)); got[0] != content {
+			t.Errorf("saved %s %q, want %q", name, got[0], content)
+		}
+	}
+
+	var sidecar attachmentSidecar
+	if err := json.Unmarshal([]byte(savedFiles(t, dir, "acme.example/statement.pdf.json")[0]), &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("%PDF march"))
+	wantSidecar := attachmentSidecar{
+		Filename:    "statement.pdf",
+		ContentType: "application/pdf",
+		Size:        len("%PDF march"),
+		SHA256:      hex.EncodeToString(sum[:]),
+		Mailbox:     "INBOX",
+		UID:         7, // after the message the backend starts with
+		UIDValidity: 1,
+		MessageID:   "march@acme.example",
+		Date:        time.Date(2026, time.March, 2, 9, 0, 0, 0, time.UTC),
+		Subject:     "Statement",
+		From:        []webhookAddress{{Name: "Acme Billing", Address: "billing@acme.example"}},
+		To:          []webhookAddress{{Address: "me@example.com"}},
+	}
+	if !reflect.DeepEqual(sidecar, wantSidecar) {
+		t.Errorf("got sidecar %+v, want %+v", sidecar, wantSidecar)
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	tests := []struct {
+		filename  string
+		mediaType string
+		want      string
+	}{
+		{"statement.pdf", "application/pdf", "statement.pdf"},
+		{"../../.ssh/authorized_keys", "text/plain", "authorized_keys"},
+		{`C:\Users\alice\report.docx`, "application/octet-stream", "report.docx"},
+		{".bashrc", "text/plain", "bashrc"},
+		{"a<b>:c|d?.txt", "text/plain", "a_b__c_d_.txt"},
+		{"line\nbreak.txt", "text/plain", "line_break.txt"},
+		{"", "application/pdf", "attachment.pdf"},
+		{"..", "application/x-unknown", "attachment"},
+		{strings.Repeat("a", 300) + ".pdf", "application/pdf", strings.Repeat("a", 233) + ".pdf"},
+		{strings.Repeat("é", 150), "text/plain", strings.Repeat("é", 118)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := attachmentName(messagePart{Filename: tt.filename, MediaType: tt.mediaType})
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule runs a block of rules at times independent of changes to its
+// mailbox.
+type Schedule interface {
+	// Next returns the first time the block should run after t.
+	Next(t time.Time) time.Time
+}
+
+// Resume returns when a block should first run after the daemon starts at
+// now, given when it last ran, or the zero time if it never has. A run missed
+// while the daemon was stopped is due at once, as is the first run of an
+// interval, so that restarting more often than the interval doesn't keep the
+// block from running.
+func Resume(s Schedule, last time.Time, now time.Time) time.Time {
+	if !last.IsZero() {
+		return s.Next(last)
+	}
+	if _, ok := s.(IntervalSchedule); ok {
+		return now
+	}
+	return s.Next(now)
+}
+
+// IntervalSchedule runs a block at a fixed interval.
+type IntervalSchedule time.Duration
+
+func (s IntervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func (s IntervalSchedule) String() string {
+	return fmt.Sprintf("every %s", formatDuration(time.Duration(s)))
+}
+
+// CronSchedule runs a block at the times matched by a five field cron
+// expression: minute, hour, day of month, month and day of week.
+type CronSchedule struct {
+	spec    string
+	minutes uint64
+	hours   uint64
+	days    uint64
+	months  uint64
+	weekday uint64
+	// Whether the day of month or day of week fields match every day, as
+	// with `*` or `1-31`. If neither does, a day matching either field is
+	// matched.
+	anyDay, anyWeekday bool
+}
+
+func NewCronSchedule(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression `%s`: expected 5 fields but found %d", spec, len(fields))
+	}
+	s := &CronSchedule{spec: spec}
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron expression `%s`: minute: %w", spec, err)
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron expression `%s`: hour: %w", spec, err)
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron expression `%s`: day of month: %w", spec, err)
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron expression `%s`: month: %w", spec, err)
+	}
+	if s.weekday, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron expression `%s`: day of week: %w", spec, err)
+	}
+	if s.weekday&(1<<7) != 0 {
+		s.weekday |= 1 // 7 is also Sunday
+	}
+	s.anyDay = s.days == cronRange(1, 31)
+	s.anyWeekday = s.weekday&cronRange(0, 6) == cronRange(0, 6)
+	return s, nil
+}
+
+// cronRange is the bit set of the values from lo to hi.
+func cronRange(lo, hi int) uint64 {
+	return 1<<(hi+1) - 1<<lo
+}
+
+// parseCronField parses a comma separated list of values, ranges (1-5) and
+// steps (*/15 or 1-30/2) into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, term := range strings.Split(field, ",") {
+		rng, step := term, 1
+		if i := strings.IndexByte(term, '/'); i >= 0 {
+			var err error
+			rng = term[:i]
+			step, err = strconv.Atoi(term[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("malformed step in `%s`", term)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("malformed value in `%s`", term)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("malformed range in `%s`", term)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("`%s` out of range %d-%d", term, min, max)
+		}
+		for i := lo; i <= hi; i += step {
+			set |= 1 << i
+		}
+	}
+	return set, nil
+}
+
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every schedule matches at least once in any span of five years
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekday&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+func (s *CronSchedule) String() string {
+	return fmt.Sprintf("at \"%s\"", s.spec)
+}
@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntervalSchedule(t *testing.T) {
+	start := time.Date(2026, time.March, 2, 9, 30, 15, 0, time.UTC)
+	s := IntervalSchedule(6 * time.Hour)
+	if got, want := s.Next(start), start.Add(6*time.Hour); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := s.String(), "every 6h"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	// A Monday
+	start := time.Date(2026, time.March, 2, 9, 30, 15, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want []time.Time // the next few times after start
+	}{
+		{"* * * * *", []time.Time{
+			time.Date(2026, time.March, 2, 9, 31, 0, 0, time.UTC),
+			time.Date(2026, time.March, 2, 9, 32, 0, 0, time.UTC),
+		}},
+		{"*/15 * * * *", []time.Time{
+			time.Date(2026, time.March, 2, 9, 45, 0, 0, time.UTC),
+			time.Date(2026, time.March, 2, 10, 0, 0, 0, time.UTC),
+		}},
+		{"0 7 * * *", []time.Time{
+			time.Date(2026, time.March, 3, 7, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 4, 7, 0, 0, 0, time.UTC),
+		}},
+		{"0 9 * * 1-5", []time.Time{
+			time.Date(2026, time.March, 3, 9, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 4, 9, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 5, 9, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 6, 9, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 9, 9, 0, 0, 0, time.UTC),
+		}},
+		{"0,30 8-9 * * *", []time.Time{
+			time.Date(2026, time.March, 3, 8, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 3, 8, 30, 0, 0, time.UTC),
+			time.Date(2026, time.March, 3, 9, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 3, 9, 30, 0, 0, time.UTC),
+		}},
+		// Day of month or day of week, when both are restricted
+		{"0 0 13 * 5", []time.Time{
+			time.Date(2026, time.March, 6, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 13, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 20, 0, 0, 0, 0, time.UTC),
+		}},
+		// 1-31 matches every day, leaving only the day of week
+		{"0 0 1-31 * 1", []time.Time{
+			time.Date(2026, time.March, 9, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 16, 0, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 * * 7", []time.Time{
+			time.Date(2026, time.March, 8, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 1 */6 *", []time.Time{
+			time.Date(2026, time.July, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 29 2 *", []time.Time{
+			time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC),
+			time.Date(2032, time.February, 29, 0, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 31 2 *", []time.Time{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := NewCronSchedule(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := start
+			for _, want := range tt.want {
+				at = s.Next(at)
+				if !at.Equal(want) {
+					t.Fatalf("got %s, want %s", at, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewCronScheduleErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"0 7 * *", "expected 5 fields but found 4"},
+		{"60 * * * *", "minute: `60` out of range 0-59"},
+		{"0 24 * * *", "hour: `24` out of range 0-23"},
+		{"0 0 0 * *", "day of month: `0` out of range 1-31"},
+		{"0 0 * 13 *", "month: `13` out of range 1-12"},
+		{"0 0 * * 8", "day of week: `8` out of range 0-7"},
+		{"0 17-9 * * *", "hour: `17-9` out of range 0-23"},
+		{"*/0 * * * *", "minute: malformed step in `*/0`"},
+		{"a * * * *", "minute: malformed value in `a`"},
+		{"0 9-b * * *", "hour: malformed range in `9-b`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := NewCronSchedule(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	now := time.Date(2026, time.March, 2, 9, 30, 15, 0, time.UTC)
+	daily, err := NewCronSchedule("0 7 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		last     time.Time
+		want     time.Time
+	}{
+		{"interval never run", IntervalSchedule(6 * time.Hour), time.Time{}, now},
+		{"interval run recently", IntervalSchedule(6 * time.Hour), now.Add(-time.Hour), now.Add(5 * time.Hour)},
+		{"interval missed", IntervalSchedule(6 * time.Hour), now.Add(-7 * time.Hour), now.Add(-time.Hour)},
+		{"cron never run", daily, time.Time{}, time.Date(2026, time.March, 3, 7, 0, 0, 0, time.UTC)},
+		{"cron run today", daily, time.Date(2026, time.March, 2, 7, 0, 0, 0, time.UTC), time.Date(2026, time.March, 3, 7, 0, 0, 0, time.UTC)},
+		{"cron missed", daily, time.Date(2026, time.February, 27, 7, 0, 0, 0, time.UTC), time.Date(2026, time.February, 28, 7, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Resume(tt.schedule, tt.last, now); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// SentIndex records the recipients and message ids of the mail the user has
+// sent, read from the SPECIAL-USE \Sent mailbox. It is updated incrementally
+// as mail is sent and persisted between restarts.
+type SentIndex struct {
+	store *Store
+	used  bool
+	ready chan struct{}
+
+	mu    sync.Mutex
+	state sentState
+}
+
+type sentState struct {
+	UIDValidity uint32          `json:"uidValidity"`
+	LastUID     uint32          `json:"lastUid"`
+	Recipients  map[string]bool `json:"recipients"`
+	MessageIDs  map[string]bool `json:"messageIds"`
+}
+
+func NewSentIndex(store *Store) *SentIndex {
+	return &SentIndex{store: store, ready: make(chan struct{})}
+}
+
+// Used reports whether any rule relies on the index, in which case the
+// daemon must keep it up to date.
+func (s *SentIndex) Used() bool {
+	return s.used
+}
+
+// Refresh reads the messages added to the Sent mailbox, which must be
+// selected, since the last refresh.
+func (s *SentIndex) Refresh(c *client.Client, mbox *imap.MailboxStatus) error {
+	s.mu.Lock()
+	if s.state.Recipients == nil {
+		if err := s.store.Load("sent", &s.state); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	if s.state.UIDValidity != mbox.UidValidity || s.state.Recipients == nil {
+		s.state = sentState{
+			UIDValidity: mbox.UidValidity,
+			Recipients:  make(map[string]bool),
+			MessageIDs:  make(map[string]bool),
+		}
+	}
+	from := s.state.LastUID + 1
+	s.mu.Unlock()
+
+	if mbox.Messages > 0 {
+		seqset := new(imap.SeqSet)
+		seqset.AddRange(from, 0)
+		messages := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+		}()
+		n := 0
+		for msg := range messages {
+			if msg.Uid < from {
+				continue // `n:*` includes the last message even if its uid is below n
+			}
+			s.add(msg)
+			n++
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("read sent mail: %w", err)
+		}
+		if n > 0 {
+			s.store.Changed("sent", s)
+		}
+	}
+
+	select {
+	case <-s.ready:
+	default:
+		close(s.ready)
+	}
+	return nil
+}
+
+func (s *SentIndex) add(msg *imap.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, addresses := range [][]*imap.Address{msg.Envelope.To, msg.Envelope.Cc, msg.Envelope.Bcc} {
+		for _, address := range addresses {
+			s.state.Recipients[strings.ToLower(address.Address())] = true
+		}
+	}
+	if id := normalizeMessageID(msg.Envelope.MessageId); id != "" {
+		s.state.MessageIDs[id] = true
+	}
+	s.state.LastUID = max(s.state.LastUID, msg.Uid)
+}
+
+// Recipient reports whether the user has sent mail to address. It waits for
+// the Sent mailbox to have been read, so that rules are not applied with an
+// incomplete index.
+func (s *SentIndex) Recipient(address string) bool {
+	<-s.ready
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Recipients[strings.ToLower(address)]
+}
+
+// Message reports whether the user sent the message with the Message-ID id.
+// Like Recipient, it waits for the Sent mailbox to have been read.
+func (s *SentIndex) Message(id string) bool {
+	<-s.ready
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.MessageIDs[normalizeMessageID(id)]
+}
+
+func (s *SentIndex) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s.state)
+}
+
+// CorrespondentPredicate matches messages from someone the user has sent mail
+// to, which separates people from bulk senders.
+type CorrespondentPredicate struct {
+	Field string
+	Sent  *SentIndex
+}
+
+func NewCorrespondentPredicate(field string, sent *SentIndex) (*CorrespondentPredicate, error) {
+	switch field {
+	case "from", "reply-to":
+	default:
+		return nil, fmt.Errorf("unknown field '%s' for correspondent, expected one of [from, reply-to]", field)
+	}
+	sent.used = true
+	return &CorrespondentPredicate{Field: field, Sent: sent}, nil
+}
+
+func (p *CorrespondentPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	addresses := msg.Envelope.From
+	if p.Field == "reply-to" {
+		addresses = msg.Envelope.ReplyTo
+	}
+	for _, address := range addresses {
+		if p.Sent.Recipient(address.Address()) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+func (p *CorrespondentPredicate) String() string {
+	return fmt.Sprintf("%s is correspondent", p.Field)
+}
+
+// SpecialUseMailbox finds the mailbox with a SPECIAL-USE attribute, as
+// described in RFC 6154, such as \Sent or \Trash.
+func SpecialUseMailbox(c *client.Client, attr string) (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+	var found string
+	for mailbox := range mailboxes {
+		for _, a := range mailbox.Attributes {
+			if strings.EqualFold(a, attr) && found == "" {
+				found = mailbox.Name
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return "", fmt.Errorf("list mailboxes: %w", err)
+	}
+	if found == "" {
+		return "", fmt.Errorf("no mailbox has the %s attribute", attr)
+	}
+	return found, nil
+}
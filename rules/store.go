@@ -0,0 +1,245 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// An Environment is the configuration of the daemon shared by its rules.
+type Environment struct {
+	// Store persists the state of rules across restarts.
+	Store *Store
+	// Sent indexes the mail the user has sent.
+	Sent *SentIndex
+	// HTTPClient makes the requests of rules which call web services.
+	HTTPClient *http.Client
+	// SMTP submits the mail sent by rules, if configured.
+	SMTP *SMTPRelay
+	// ClassifyTimeout bounds each request to a classifier.
+	ClassifyTimeout time.Duration
+	// PipeTimeout bounds each command run by a pipe rule.
+	PipeTimeout time.Duration
+	// PipeConcurrency limits how many commands run at once, across every
+	// pipe rule.
+	PipeConcurrency int
+
+	pipes chan struct{}
+}
+
+func (env *Environment) httpClient() *http.Client {
+	if env.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return env.HTTPClient
+}
+
+// pipeSlots returns the semaphore limiting the commands run at once.
+func (env *Environment) pipeSlots() chan struct{} {
+	if env.pipes == nil {
+		n := env.PipeConcurrency
+		if n < 1 {
+			n = DefaultPipeConcurrency
+		}
+		env.pipes = make(chan struct{}, n)
+	}
+	return env.pipes
+}
+
+// A Store persists state across restarts as JSON files in a directory. State
+// is held in memory alone if the directory is empty.
+type Store struct {
+	Dir string
+
+	mu      sync.Mutex
+	dirty   map[string]json.Marshaler
+	ledgers map[string]*Ledger
+}
+
+func NewStore(dir string) *Store {
+	return &Store{Dir: dir, dirty: make(map[string]json.Marshaler)}
+}
+
+// Load reads the state saved under name into v. It is not an error for there
+// to be no saved state.
+func (s *Store) Load(name string, v any) error {
+	if s.Dir == "" {
+		return nil
+	}
+	buf, err := os.ReadFile(filepath.Join(s.Dir, name+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("load %s: %w", name, err)
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("load %s: %w", name, err)
+	}
+	return nil
+}
+
+// Changed records that the state under name has changed, so that it is
+// written by the next Flush. v must be safe to marshal concurrently with its
+// use by rules.
+func (s *Store) Changed(name string, v json.Marshaler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty[name] = v
+}
+
+// Flush writes the changed state to disk. Each file is replaced atomically.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]json.Marshaler)
+	s.mu.Unlock()
+	if s.Dir == "" {
+		return nil
+	}
+
+	var errs []error
+	for name, v := range dirty {
+		if err := s.write(name, v); err != nil {
+			errs = append(errs, err)
+			s.Changed(name, v) // retry with the next flush
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) write(name string, v json.Marshaler) error {
+	buf, err := v.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("save %s: %w", name, err)
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("save %s: %w", name, err)
+	}
+	f, err := os.CreateTemp(s.Dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("save %s: %w", name, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("save %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("save %s: %w", name, err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(s.Dir, name+".json")); err != nil {
+		return fmt.Errorf("save %s: %w", name, err)
+	}
+	return nil
+}
+
+// A Ledger records actions which must be taken at most once, such as
+// unsubscribing from a list, so that they are not repeated after a restart.
+type Ledger struct {
+	name  string
+	store *Store
+
+	mu      sync.Mutex
+	entries map[string]LedgerEntry
+}
+
+type LedgerEntry struct {
+	Time time.Time `json:"time"`
+	// Note describes the outcome, such as an error.
+	Note string `json:"note,omitempty"`
+}
+
+// Ledger returns the ledger saved under name, which is shared by every rule
+// using it.
+func (s *Store) Ledger(name string) (*Ledger, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.ledgers[name]; ok {
+		return l, nil
+	}
+	l := &Ledger{name: name, store: s, entries: make(map[string]LedgerEntry)}
+	if err := s.Load(name, &l.entries); err != nil {
+		return nil, err
+	}
+	if s.ledgers == nil {
+		s.ledgers = make(map[string]*Ledger)
+	}
+	s.ledgers[name] = l
+	return l, nil
+}
+
+// Done reports whether key has been recorded.
+func (l *Ledger) Done(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[key]
+	return ok
+}
+
+// Record records key, returning false if it already was.
+func (l *Ledger) Record(key string, note string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[key]; ok {
+		return false
+	}
+	l.entries[key] = LedgerEntry{Time: time.Now(), Note: note}
+	l.store.Changed(l.name, l)
+	return true
+}
+
+// Time returns when key was recorded.
+func (l *Ledger) Time(key string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[key]
+	return entry.Time, ok
+}
+
+// Note returns the note recorded with key.
+func (l *Ledger) Note(key string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[key]
+	return entry.Note, ok
+}
+
+// Renew records key afresh, for actions repeated at an interval.
+func (l *Ledger) Renew(key string, note string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[key] = LedgerEntry{Time: time.Now(), Note: note}
+	l.store.Changed(l.name, l)
+}
+
+// Forget removes key, so that the action may be taken again, such as after
+// it failed.
+func (l *Ledger) Forget(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+	l.store.Changed(l.name, l)
+}
+
+// Annotate replaces the note recorded for key, such as with the outcome of
+// the action.
+func (l *Ledger) Annotate(key string, note string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := l.entries[key]
+	entry.Note = note
+	l.entries[key] = entry
+	l.store.Changed(l.name, l)
+}
+
+func (l *Ledger) MarshalJSON() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return json.Marshal(l.entries)
+}
@@ -0,0 +1,177 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// ProtectedDomains are domains which lookalike senders are likely to imitate,
+// such as the user's bank or employer.
+type ProtectedDomains struct {
+	Domains []string
+}
+
+func (d *ProtectedDomains) Add(domains ...string) {
+	for _, domain := range domains {
+		d.Domains = append(d.Domains, normalizeDomain(domain))
+	}
+}
+
+// SuspiciousSenderPredicate matches messages whose sender appears spoofed:
+// the From domain imitates a protected domain, the display name contains a
+// different address, or replies are directed to another domain.
+type SuspiciousSenderPredicate struct {
+	Protected *ProtectedDomains
+}
+
+func NewSuspiciousPredicate(subject string, protected *ProtectedDomains) (*SuspiciousSenderPredicate, error) {
+	if subject != "sender" {
+		return nil, fmt.Errorf("unknown suspicious '%s', expected sender", subject)
+	}
+	return &SuspiciousSenderPredicate{Protected: protected}, nil
+}
+
+var displayNameAddressPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+func (p *SuspiciousSenderPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	from := firstAddress(msg.Envelope.From)
+	if from.HostName == "" {
+		return nil, false
+	}
+	fromDomain := normalizeDomain(from.HostName)
+
+	for _, protected := range p.Protected.Domains {
+		if DomainPredicate(protected).MatchString(fromDomain) {
+			continue // the genuine domain
+		}
+		if lookalikeDomain(fromDomain, protected) {
+			log.Printf("Sender '%s' imitates '%s'", from.Address(), protected)
+			return nil, true
+		}
+	}
+
+	for _, address := range displayNameAddressPattern.FindAllString(from.PersonalName, -1) {
+		if !strings.EqualFold(address, from.Address()) {
+			log.Printf("Sender '%s' displays address '%s'", from.Address(), address)
+			return nil, true
+		}
+	}
+
+	for _, replyTo := range msg.Envelope.ReplyTo {
+		if replyTo.HostName != "" && normalizeDomain(replyTo.HostName) != fromDomain {
+			log.Printf("Sender '%s' directs replies to '%s'", from.Address(), replyTo.Address())
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+func (p *SuspiciousSenderPredicate) String() string {
+	return "suspicious sender"
+}
+
+// normalizeDomain converts a domain to lower case Unicode, so that
+// internationalized domains can be compared by their characters.
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if unicode, err := idna.ToUnicode(domain); err == nil {
+		return unicode
+	}
+	return domain
+}
+
+// lookalikeDomain reports whether domain is easily mistaken for protected.
+// Only the registered names are compared, as a different suffix alone, such
+// as ups.co for ups.com, is as likely to be the same organization. Short
+// names must be spelled with confusable characters, since a single edit to
+// one often makes another genuine name, such as fps.com for ups.com, while
+// longer names may also be a small number of edits away.
+func lookalikeDomain(domain, protected string) bool {
+	name, protectedName := registrableLabel(domain), registrableLabel(protected)
+	if name == protectedName {
+		return false
+	}
+	return editDistance(confusableSkeleton(name), confusableSkeleton(protectedName)) <= lookalikeEdits(protectedName)
+}
+
+// registrableLabel returns the name under which domain was registered,
+// which is `example` for `mail.example.co.uk`.
+func registrableLabel(domain string) string {
+	if registered, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		domain = registered
+	}
+	label, _, _ := strings.Cut(domain, ".")
+	return label
+}
+
+// lookalikeEdits is the number of edits by which a lookalike of a name may
+// differ from it, beyond confusable characters.
+func lookalikeEdits(name string) int {
+	switch n := len([]rune(name)); {
+	case n < 8:
+		return 0
+	case n < 12:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// confusables maps characters to the ASCII characters they resemble, a small
+// subset of the Unicode confusables table covering common spoofs.
+var confusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'һ': "h", 'і': "i", 'ї': "i", 'ј': "j",
+	'к': "k", 'ӏ': "l", 'м': "m", 'н': "h", 'о': "o", 'р': "p", 'с': "c", 'ѕ': "s",
+	'т': "t", 'у': "y", 'х': "x", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'ɡ': "g",
+	// Greek
+	'α': "a", 'β': "b", 'ε': "e", 'ι': "i", 'κ': "k", 'ν': "v", 'ο': "o", 'ρ': "p",
+	'τ': "t", 'υ': "u", 'χ': "x",
+	// Latin lookalikes
+	'0': "o", '1': "l", 'i': "l", 'ı': "l", 'ℓ': "l",
+}
+
+// confusableSkeleton reduces s to a form in which confusable strings are
+// equal, after the skeleton algorithm of Unicode TS #39.
+func confusableSkeleton(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if c, ok := confusables[r]; ok {
+			b.WriteString(c)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	skeleton := b.String()
+	skeleton = strings.ReplaceAll(skeleton, "rn", "m")
+	skeleton = strings.ReplaceAll(skeleton, "vv", "w")
+	return skeleton
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	curr := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		curr[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(t)]
+}
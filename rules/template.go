@@ -0,0 +1,297 @@
+package rules
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Bindings are the values captured by a predicate when it matches a message,
+// keyed by capture group number or name.
+type Bindings map[string]string
+
+// merge returns the union of b and other, preferring values in b.
+func (b Bindings) merge(other Bindings) Bindings {
+	if len(b) == 0 {
+		return other
+	}
+	if len(other) == 0 {
+		return b
+	}
+	merged := make(Bindings, len(b)+len(other))
+	for k, v := range other {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// A Template is an action argument which may refer to values bound by the
+// rule's predicate, as `$1` or `${vendor}`, and to attributes of the message,
+// as `{{from.domain}}`. A literal `$` is written `$$`.
+type Template struct {
+	raw   string
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal  string
+	binding  string // name of the binding to substitute, if any
+	variable string // name of the message variable to substitute, if any
+}
+
+// templateVariables are the message attributes a template may refer to.
+var templateVariables = map[string]func(*imap.Message) string{
+	"date.year":   func(msg *imap.Message) string { return messageDate(msg).Format("2006") },
+	"date.month":  func(msg *imap.Message) string { return messageDate(msg).Format("01") },
+	"date.day":    func(msg *imap.Message) string { return messageDate(msg).Format("02") },
+	"from":        func(msg *imap.Message) string { return firstAddress(msg.Envelope.From).Address() },
+	"from.user":   func(msg *imap.Message) string { return firstAddress(msg.Envelope.From).MailboxName },
+	"from.domain": func(msg *imap.Message) string { return strings.ToLower(firstAddress(msg.Envelope.From).HostName) },
+	"from.name":   func(msg *imap.Message) string { return firstAddress(msg.Envelope.From).PersonalName },
+	"to":          func(msg *imap.Message) string { return firstAddress(msg.Envelope.To).Address() },
+	"to.user":     func(msg *imap.Message) string { return firstAddress(msg.Envelope.To).MailboxName },
+	"to.domain":   func(msg *imap.Message) string { return strings.ToLower(firstAddress(msg.Envelope.To).HostName) },
+	"subject":     func(msg *imap.Message) string { return msg.Envelope.Subject },
+	"list.id":     func(msg *imap.Message) string { return listID(messageHeader(msg)) },
+}
+
+func NewTemplate(s string) (*Template, error) {
+	t := &Template{raw: s}
+	var literal strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "{{") {
+			end := strings.Index(s[i:], "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("template `%s`: unterminated `{{`", s)
+			}
+			name := strings.TrimSpace(s[i+2 : i+end])
+			if _, ok := templateVariables[name]; !ok {
+				return nil, fmt.Errorf("template `%s`: unknown variable `%s`, expected one of [%s]", s, name, strings.Join(templateVariableNames(), ", "))
+			}
+			t.parts = append(t.parts, templatePart{literal: literal.String(), variable: name})
+			literal.Reset()
+			i += end + 1
+			continue
+		}
+		if s[i] != '$' {
+			literal.WriteByte(s[i])
+			continue
+		}
+		i++
+		var name string
+		switch {
+		case i == len(s):
+			return nil, fmt.Errorf("template `%s`: trailing `$`", s)
+		case s[i] == '$':
+			literal.WriteByte('$')
+			continue
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("template `%s`: unterminated `${`", s)
+			}
+			name = s[i+1 : i+end]
+			i += end
+		case isDigit(s[i]):
+			j := i
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			name = s[i:j]
+			i = j - 1
+		case isNameStart(s[i]):
+			j := i
+			for j < len(s) && (isNameStart(s[j]) || isDigit(s[j])) {
+				j++
+			}
+			name = s[i:j]
+			i = j - 1
+		default:
+			return nil, fmt.Errorf("template `%s`: unexpected `%c` after `$`", s, s[i])
+		}
+		if !validBindingName(name) {
+			return nil, fmt.Errorf("template `%s`: invalid reference `%s`", s, name)
+		}
+		t.parts = append(t.parts, templatePart{literal: literal.String(), binding: name})
+		literal.Reset()
+	}
+	if literal.Len() > 0 {
+		t.parts = append(t.parts, templatePart{literal: literal.String()})
+	}
+	return t, nil
+}
+
+// Expand substitutes bindings and attributes of msg into the template.
+// References to values which were not bound expand to the empty string.
+func (t *Template) Expand(msg *imap.Message, bindings Bindings) string {
+	return t.expand(msg, bindings, func(s string) string { return s })
+}
+
+// expand is Expand with each substituted value passed through escape.
+func (t *Template) expand(msg *imap.Message, bindings Bindings, escape func(string) string) string {
+	var b strings.Builder
+	for _, part := range t.parts {
+		b.WriteString(part.literal)
+		switch {
+		case part.binding != "":
+			b.WriteString(escape(bindings[part.binding]))
+		case part.variable != "":
+			b.WriteString(escape(templateVariables[part.variable](msg)))
+		}
+	}
+	return b.String()
+}
+
+// Check reports an error if the template refers to a value which the
+// predicate can never bind.
+func (t *Template) Check(predicate Predicate) error {
+	bound := make(map[string]bool)
+	for _, name := range predicateBindings(predicate) {
+		bound[name] = true
+	}
+	for _, part := range t.parts {
+		if part.binding != "" && !bound[part.binding] {
+			return fmt.Errorf("template `%s` refers to `%s` which is not captured by the predicate", t.raw, part.binding)
+		}
+	}
+	return nil
+}
+
+func (t *Template) fetchItems() []imap.FetchItem {
+	for _, part := range t.parts {
+		if part.variable == "list.id" {
+			return headerItems()
+		}
+	}
+	return nil
+}
+
+// templateFetchItems lists the items the templates of a rule read, beyond
+// those of its predicate.
+func templateFetchItems(templates ...*Template) []imap.FetchItem {
+	var items []imap.FetchItem
+	for _, t := range templates {
+		items = append(items, t.fetchItems()...)
+	}
+	return items
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+func templateVariableNames() []string {
+	names := make([]string, 0, len(templateVariables))
+	for name := range templateVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// messageDate is the date the message was sent, or failing that the date it
+// was received.
+func messageDate(msg *imap.Message) time.Time {
+	if !msg.Envelope.Date.IsZero() {
+		return msg.Envelope.Date
+	}
+	return msg.InternalDate
+}
+
+func firstAddress(addresses []*imap.Address) *imap.Address {
+	if len(addresses) == 0 {
+		return &imap.Address{}
+	}
+	return addresses[0]
+}
+
+// listID extracts the identifier from a List-Id header, as described in
+// RFC 2919, for example `Announcements <announce.example.com>`.
+func listID(header mail.Header) string {
+	id := header.Get("List-Id")
+	if start := strings.LastIndexByte(id, '<'); start >= 0 {
+		if end := strings.IndexByte(id[start:], '>'); end >= 0 {
+			return strings.ToLower(id[start+1 : start+end])
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// bindingPredicate is implemented by predicates which bind values when they
+// match a message.
+type bindingPredicate interface {
+	bindings() []string
+}
+
+// predicateBindings lists the names the predicate binds whenever it matches.
+func predicateBindings(predicate Predicate) []string {
+	if p, ok := predicate.(bindingPredicate); ok {
+		return p.bindings()
+	}
+	return nil
+}
+
+// regexpBindings lists the capture group numbers and names of rexp.
+func regexpBindings(rexp *regexp.Regexp) []string {
+	var names []string
+	for i, name := range rexp.SubexpNames() {
+		names = append(names, strconv.Itoa(i))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// regexpMatch returns the capture groups of the leftmost match of rexp in s.
+func regexpMatch(rexp *regexp.Regexp, s string) (Bindings, bool) {
+	match := rexp.FindStringSubmatch(s)
+	if match == nil {
+		return nil, false
+	}
+	bindings := make(Bindings, len(match))
+	for i, name := range rexp.SubexpNames() {
+		bindings[strconv.Itoa(i)] = match[i]
+		if name != "" {
+			bindings[name] = match[i]
+		}
+	}
+	return bindings, true
+}
+
+func validBindingName(name string) bool {
+	if name == "" {
+		return false
+	}
+	if isDigit(name[0]) {
+		for i := 0; i < len(name); i++ {
+			if !isDigit(name[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameStart(name[i]) && !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
@@ -0,0 +1,132 @@
+package rules
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// fieldMatches matches field against the regular expression expr.
+func fieldMatches(t *testing.T, field string, expr string) Predicate {
+	t.Helper()
+	p, err := NewFieldPredicate(field, regexp.MustCompile(expr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTemplateExpand(t *testing.T) {
+	msg := &imap.Message{Envelope: &imap.Envelope{
+		Date:    time.Date(2026, time.March, 2, 9, 0, 0, 0, time.UTC),
+		Subject: "Invoice 42",
+		From:    []*imap.Address{{PersonalName: "Acme Billing", MailboxName: "billing", HostName: "Acme.example"}},
+		To:      []*imap.Address{{MailboxName: "me", HostName: "example.com"}},
+	}}
+	tests := []struct {
+		template  string
+		predicate Predicate
+		want      string
+	}{
+		{"Receipts", fieldMatches(t, "subject", "Invoice"), "Receipts"},
+		{"Receipts/$1", fieldMatches(t, "subject", `Invoice ([0-9]+)`), "Receipts/42"},
+		{"Receipts/${1}0", fieldMatches(t, "subject", `Invoice ([0-9]+)`), "Receipts/420"},
+		{"Receipts/${vendor}", fieldMatches(t, "from", `@(?P<vendor>\w+)\.example$`), "Receipts/Acme"},
+		{"Receipts/$vendor", fieldMatches(t, "from", `@(?P<vendor>\w+)\.example$`), "Receipts/Acme"},
+		{"$$1", fieldMatches(t, "subject", `Invoice ([0-9]+)`), "$1"},
+		{"Receipts/$1", &AndPredicate{
+			Left:  fieldMatches(t, "from", "^billing@"),
+			Right: fieldMatches(t, "subject", `Invoice ([0-9]+)`),
+		}, "Receipts/42"},
+		{"{{from.domain}}/{{date.year}}-{{date.month}}", fieldMatches(t, "subject", "Invoice"), "acme.example/2026-03"},
+		{"{{ from.name }}: {{subject}}", fieldMatches(t, "subject", "Invoice"), "Acme Billing: Invoice 42"},
+		{"{{from.user}} to {{to}}", fieldMatches(t, "subject", "Invoice"), "billing to me@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := NewTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tmpl.Check(tt.predicate); err != nil {
+				t.Fatal(err)
+			}
+			bindings, ok := tt.predicate.MatchMessage(msg)
+			if !ok {
+				t.Fatalf("%s doesn't match", tt.predicate)
+			}
+			if got := tmpl.Expand(msg, bindings); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		predicate Predicate
+		err       string
+	}{
+		{"group", "$1", fieldMatches(t, "subject", `Invoice ([0-9]+)`), ""},
+		{"named group", "${vendor}", fieldMatches(t, "from", `@(?P<vendor>\w+)\.`), ""},
+		{"whole match", "$0", fieldMatches(t, "subject", "Invoice"), ""},
+		{"missing group", "$2", fieldMatches(t, "subject", `Invoice ([0-9]+)`), "refers to `2`"},
+		{"missing name", "${vendor}", fieldMatches(t, "subject", `Invoice ([0-9]+)`), "refers to `vendor`"},
+		{"no regular expression", "$1", &NotPredicate{Predicate: &BulkPredicate{}}, "refers to `1`"},
+		{"negated", "$1", &NotPredicate{Predicate: fieldMatches(t, "subject", `Invoice ([0-9]+)`)}, "refers to `1`"},
+		{"either side of and", "${vendor}", &AndPredicate{
+			Left:  &BulkPredicate{},
+			Right: fieldMatches(t, "from", `@(?P<vendor>\w+)\.`),
+		}, ""},
+		{"both sides of or", "${vendor}", &OrPredicate{
+			Left:  fieldMatches(t, "from", `@(?P<vendor>\w+)\.`),
+			Right: fieldMatches(t, "to", `^(?P<vendor>\w+)@`),
+		}, ""},
+		{"one side of or", "${vendor}", &OrPredicate{
+			Left:  &BulkPredicate{},
+			Right: fieldMatches(t, "from", `@(?P<vendor>\w+)\.`),
+		}, "refers to `vendor`"},
+		{"attributes only", "{{from.domain}}", &BulkPredicate{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := NewTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tmpl.Check(tt.predicate)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewTemplateErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{"Receipts/$", "trailing `$`"},
+		{"Receipts/${vendor", "unterminated `${`"},
+		{"Receipts/$-", "unexpected `-` after `$`"},
+		{"Receipts/{{from.domain", "unterminated `{{`"},
+		{"Receipts/{{sender}}", "unknown variable `sender`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			_, err := NewTemplate(tt.template)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// normalizeMessageID strips the angle brackets and whitespace around a
+// Message-ID, so that ids from the envelope and from headers compare equal.
+func normalizeMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// parentIDs returns the Message-IDs msg replies to, from the In-Reply-To and
+// References headers, as described in RFC 5322.
+func parentIDs(msg *imap.Message) []string {
+	header := messageHeader(msg)
+	var ids []string
+	for _, value := range []string{msg.Envelope.InReplyTo, header.Get("References")} {
+		for {
+			start := strings.IndexByte(value, '<')
+			if start < 0 {
+				break
+			}
+			end := strings.IndexByte(value[start:], '>')
+			if end < 0 {
+				break
+			}
+			ids = append(ids, normalizeMessageID(value[start:start+end+1]))
+			value = value[start+end+1:]
+		}
+	}
+	return ids
+}
+
+// ReplyPredicate matches replies, which refer to an earlier message.
+type ReplyPredicate struct{}
+
+func (p *ReplyPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	return nil, len(parentIDs(msg)) > 0
+}
+
+func (p *ReplyPredicate) fetchItems() []imap.FetchItem {
+	return headerItems()
+}
+
+func (p *ReplyPredicate) String() string {
+	return "is reply"
+}
+
+// ThreadPredicate matches the subject of the thread a message belongs to,
+// which is its subject without reply and forward prefixes, so that it matches
+// the first message of a thread and every reply alike.
+type ThreadPredicate struct {
+	Predicate StringPredicate
+}
+
+func (p *ThreadPredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	return matchString(p.Predicate, baseSubject(msg.Envelope.Subject))
+}
+
+func (p *ThreadPredicate) bindings() []string {
+	return stringPredicateBindings(p.Predicate)
+}
+
+func (p *ThreadPredicate) String() string {
+	return fmt.Sprintf("in thread with %s", formatStringPredicate("subject", p.Predicate))
+}
+
+// RepliesToMePredicate matches replies to mail the user has sent.
+type RepliesToMePredicate struct {
+	Sent *SentIndex
+}
+
+func NewRepliesToMePredicate(sent *SentIndex) *RepliesToMePredicate {
+	sent.used = true
+	return &RepliesToMePredicate{Sent: sent}
+}
+
+func (p *RepliesToMePredicate) MatchMessage(msg *imap.Message) (Bindings, bool) {
+	for _, id := range parentIDs(msg) {
+		if p.Sent.Message(id) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+func (p *RepliesToMePredicate) fetchItems() []imap.FetchItem {
+	return headerItems()
+}
+
+func (p *RepliesToMePredicate) String() string {
+	return "replies to me"
+}
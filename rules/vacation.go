@@ -0,0 +1,248 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// VacationRule replies to matching messages while the user is away, as an
+// automatic responder following RFC 3834. It replies to each sender at most
+// once per interval, and never to automatic or bulk mail, nor to mail which
+// wasn't addressed to one of the user's identities.
+type VacationRule struct {
+	Predicate Predicate
+	Subject   *Template
+	Body      *Template
+	// The days the user is away, from the start of Start to the end of
+	// Until, each zero if unbounded.
+	Start, Until time.Time
+	Days         int
+	identities   *Identities
+	relay        *SMTPRelay
+	ledger       *Ledger
+	// Mail received before the rule was created is not replied to, if no
+	// start is given, so that the mailbox's backlog is not answered.
+	created time.Time
+	replies map[string]vacationReply // by sender
+}
+
+type vacationReply struct {
+	subject    string
+	body       string
+	inReplyTo  string
+	references string
+}
+
+// DefaultVacationDays is the interval between replies to the same sender,
+// recommended by RFC 3834.
+const DefaultVacationDays = 7
+
+const vacationDateLayout = "2006-01-02"
+
+// NewVacationRule constructs the rule from its options: the subject and
+// body templates, the dates from and until which the user is away, and the
+// number of days between replies to a sender.
+func NewVacationRule(predicate Predicate, options map[string]string, identities *Identities, env *Environment) (*VacationRule, error) {
+	if env.SMTP == nil {
+		return nil, fmt.Errorf("vacation requires an smtp relay, given by --smtp-host")
+	}
+	ledger, err := env.Store.Ledger("vacation")
+	if err != nil {
+		return nil, err
+	}
+	r := &VacationRule{
+		Predicate:  predicate,
+		Days:       DefaultVacationDays,
+		identities: identities,
+		relay:      env.SMTP,
+		ledger:     ledger,
+		created:    time.Now(),
+		replies:    make(map[string]vacationReply),
+	}
+	subject := "Auto: {{subject}}"
+	for name, value := range options {
+		switch name {
+		case "subject":
+			subject = value
+		case "body":
+			if r.Body, err = NewTemplate(value); err != nil {
+				return nil, err
+			}
+		case "from", "until":
+			date, err := time.ParseInLocation(vacationDateLayout, value, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("malformed date '%s', expected YYYY-MM-DD: %w", value, err)
+			}
+			if name == "from" {
+				r.Start = date
+			} else {
+				r.Until = date
+			}
+		case "days":
+			if r.Days, err = strconv.Atoi(value); err != nil || r.Days < 1 {
+				return nil, fmt.Errorf("malformed days '%s', expected a whole number of at least 1", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown vacation option '%s', expected one of [subject, body, from, until, days]", name)
+		}
+	}
+	if r.Body == nil {
+		return nil, fmt.Errorf("vacation requires a body")
+	}
+	if r.Subject, err = NewTemplate(subject); err != nil {
+		return nil, err
+	}
+	if !r.Start.IsZero() && !r.Until.IsZero() && r.Until.Before(r.Start) {
+		return nil, fmt.Errorf("vacation until %s is before it starts on %s", r.Until.Format(vacationDateLayout), r.Start.Format(vacationDateLayout))
+	}
+	return r, nil
+}
+
+// away reports whether t falls within the vacation.
+func (r *VacationRule) away(t time.Time) bool {
+	if !r.Start.IsZero() && t.Before(r.Start) {
+		return false
+	}
+	if !r.Until.IsZero() && !t.Before(r.Until.AddDate(0, 0, 1)) {
+		return false
+	}
+	return true
+}
+
+func (r VacationRule) Message(msg *imap.Message) {
+	received := msg.InternalDate
+	if received.IsZero() {
+		received = messageDate(msg)
+	}
+	if !r.away(time.Now()) || !r.away(received) || (r.Start.IsZero() && received.Before(r.created)) {
+		return
+	}
+	sender, ok := r.sender(msg)
+	if !ok {
+		return
+	}
+	if _, ok := r.replies[sender]; ok {
+		return
+	}
+	if last, ok := r.ledger.Time(sender); ok && time.Since(last) < time.Duration(r.Days)*24*time.Hour {
+		return
+	}
+	bindings, ok := r.Predicate.MatchMessage(msg)
+	if !ok {
+		return
+	}
+	log.Printf("Replying to '%s' from '%s' while on vacation", msg.Envelope.Subject, sender)
+	header := messageHeader(msg)
+	id := msg.Envelope.MessageId
+	references := strings.TrimSpace(header.Get("References") + " " + id)
+	r.replies[sender] = vacationReply{
+		subject:    r.Subject.Expand(msg, bindings),
+		body:       r.Body.Expand(msg, bindings),
+		inReplyTo:  id,
+		references: references,
+	}
+}
+
+// sender returns the address to reply to, unless msg should not be replied
+// to, following section 2 of RFC 3834.
+func (r *VacationRule) sender(msg *imap.Message) (string, bool) {
+	header := messageHeader(msg)
+	if submitted := strings.TrimSpace(header.Get("Auto-Submitted")); submitted != "" && !strings.EqualFold(submitted, "no") {
+		return "", false
+	}
+	if _, bulk := (&BulkPredicate{}).MatchMessage(msg); bulk || header.Get("List-Id") != "" {
+		return "", false
+	}
+
+	// Replies go to the envelope sender, which is empty for bounces and
+	// other automatic mail
+	sender := firstAddress(msg.Envelope.From).Address()
+	if returnPath, ok := header["Return-Path"]; ok {
+		sender = strings.Trim(strings.TrimSpace(returnPath[0]), "<>")
+	}
+	sender = strings.ToLower(sender)
+	local, _, ok := strings.Cut(sender, "@")
+	if !ok || local == "" {
+		return "", false
+	}
+	switch {
+	case local == "mailer-daemon", local == "postmaster", local == "listserv", local == "majordomo",
+		strings.HasPrefix(local, "owner-"), strings.HasSuffix(local, "-request"), strings.HasSuffix(local, "-bounces"),
+		strings.HasPrefix(local, "noreply"), strings.HasPrefix(local, "no-reply"), strings.HasPrefix(local, "donotreply"):
+		return "", false
+	}
+
+	// Never reply to ourselves, and only to mail addressed to us
+	if r.identities.Match(sender) {
+		return "", false
+	}
+	for _, addresses := range [][]*imap.Address{msg.Envelope.To, msg.Envelope.Cc} {
+		for _, address := range addresses {
+			if r.identities.Match(address.Address()) {
+				return sender, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (r *VacationRule) Action(ctx context.Context, _ *client.Client) error {
+	replies := r.replies
+	r.replies = make(map[string]vacationReply)
+
+	var errs []error
+	for sender, reply := range replies {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "From: %s\r\n", r.relay.From)
+		fmt.Fprintf(&buf, "To: %s\r\n", sender)
+		fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", reply.subject))
+		fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		fmt.Fprintf(&buf, "Message-ID: %s\r\n", newMessageID(r.relay.From))
+		if reply.inReplyTo != "" {
+			fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", reply.inReplyTo)
+		}
+		if reply.references != "" {
+			fmt.Fprintf(&buf, "References: %s\r\n", reply.references)
+		}
+		fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+		fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+		buf.WriteString(crlf(reply.body + "\n"))
+		if err := r.relay.Send(ctx, []string{sender}, buf.Bytes()); err != nil {
+			errs = append(errs, fmt.Errorf("vacation reply to `%s`: %w", sender, err))
+			continue
+		}
+		r.ledger.Renew(sender, "")
+	}
+	return errors.Join(errs...)
+}
+
+func (r *VacationRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *VacationRule) fetchItems() []imap.FetchItem {
+	return append(headerItems(), predicateFetchItems(r.Predicate)...)
+}
+
+func (r *VacationRule) String() string {
+	s := fmt.Sprintf("if %s then vacation subject \"%s\" body \"%s\"", r.Predicate, r.Subject, r.Body)
+	if !r.Start.IsZero() {
+		s += fmt.Sprintf(" from \"%s\"", r.Start.Format(vacationDateLayout))
+	}
+	if !r.Until.IsZero() {
+		s += fmt.Sprintf(" until \"%s\"", r.Until.Format(vacationDateLayout))
+	}
+	return s + fmt.Sprintf(" days %d", r.Days)
+}
@@ -0,0 +1,234 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// WebhookRule posts a JSON document describing each matching message, so
+// that the services receiving it need not parse MIME themselves.
+type WebhookRule struct {
+	Predicate Predicate
+	URL       *Template
+	// Whether to include the content of attachments, rather than only
+	// their names, types and sizes.
+	Attachments bool
+	client      *http.Client
+	messages    *imap.SeqSet
+	urls        map[uint32]string   // by message uid
+	flags       map[uint32][]string // by message uid
+	done        *imap.SeqSet
+}
+
+// webhookMessage is the document posted for a message.
+type webhookMessage struct {
+	// Rule is the rule which matched the message, as written.
+	Rule        string   `json:"rule"`
+	Mailbox     string   `json:"mailbox"`
+	UID         uint32   `json:"uid"`
+	UIDValidity uint32   `json:"uidvalidity"`
+	Flags       []string `json:"flags"`
+
+	MessageID string           `json:"message_id"`
+	InReplyTo string           `json:"in_reply_to,omitempty"`
+	Date      time.Time        `json:"date"`
+	Subject   string           `json:"subject"`
+	From      []webhookAddress `json:"from"`
+	Sender    []webhookAddress `json:"sender,omitempty"`
+	ReplyTo   []webhookAddress `json:"reply_to,omitempty"`
+	To        []webhookAddress `json:"to"`
+	Cc        []webhookAddress `json:"cc,omitempty"`
+	Bcc       []webhookAddress `json:"bcc,omitempty"`
+
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []webhookAttachment `json:"attachments"`
+}
+
+type webhookAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+type webhookAttachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+	// Data is the content of the attachment, encoded in base64 by
+	// encoding/json, if the rule includes attachments.
+	Data []byte `json:"data,omitempty"`
+}
+
+func NewWebhookRule(predicate Predicate, format string, url string, attachments bool, env *Environment) (*WebhookRule, error) {
+	if format != "json" {
+		return nil, fmt.Errorf("unknown webhook format '%s', expected one of [json]", format)
+	}
+	tmpl, err := NewTemplate(url)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookRule{
+		Predicate:   predicate,
+		URL:         tmpl,
+		Attachments: attachments,
+		client:      env.httpClient(),
+		messages:    new(imap.SeqSet),
+		urls:        make(map[uint32]string),
+		flags:       make(map[uint32][]string),
+		done:        new(imap.SeqSet),
+	}, nil
+}
+
+func (r WebhookRule) Message(msg *imap.Message) {
+	if r.done.Contains(msg.Uid) {
+		return
+	}
+	if bindings, ok := r.Predicate.MatchMessage(msg); ok {
+		target := r.URL.expand(msg, bindings, url.PathEscape)
+		log.Printf("Posting '%s' to '%s'", msg.Envelope.Subject, target)
+		r.messages.AddNum(msg.Uid)
+		r.urls[msg.Uid] = target
+		r.flags[msg.Uid] = append([]string{}, msg.Flags...)
+	}
+}
+
+func (r *WebhookRule) Action(ctx context.Context, client *client.Client) error {
+	msgs := r.messages
+	urls := r.urls
+	flags := r.flags
+	r.messages = new(imap.SeqSet)
+	r.urls = make(map[uint32]string)
+	r.flags = make(map[uint32][]string)
+	r.done.AddSet(msgs)
+	if msgs.Empty() {
+		return nil
+	}
+
+	var mailbox string
+	var uidValidity uint32
+	if status := client.Mailbox(); status != nil {
+		mailbox, uidValidity = status.Name, status.UidValidity
+	}
+	err := fetchBodies(client, msgs, func(msg *imap.Message, raw []byte) {
+		doc, err := r.document(msg, raw)
+		if err == nil {
+			doc.Mailbox, doc.UIDValidity, doc.Flags = mailbox, uidValidity, flags[msg.Uid]
+			err = r.post(ctx, urls[msg.Uid], doc)
+		}
+		if err != nil {
+			log.Printf("post message %d to `%s`: %v", msg.Uid, urls[msg.Uid], err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("post messages to `%s`: %w", r.URL, err)
+	}
+	return nil
+}
+
+// document describes msg, parsing its bodies and attachments from raw.
+func (r *WebhookRule) document(msg *imap.Message, raw []byte) (*webhookMessage, error) {
+	if raw == nil {
+		return nil, fmt.Errorf("body not fetched")
+	}
+	doc := &webhookMessage{
+		Rule:        r.String(),
+		UID:         msg.Uid,
+		MessageID:   normalizeMessageID(msg.Envelope.MessageId),
+		InReplyTo:   normalizeMessageID(msg.Envelope.InReplyTo),
+		Date:        messageDate(msg),
+		Subject:     msg.Envelope.Subject,
+		From:        webhookAddresses(msg.Envelope.From),
+		Sender:      webhookAddresses(msg.Envelope.Sender),
+		ReplyTo:     webhookAddresses(msg.Envelope.ReplyTo),
+		To:          webhookAddresses(msg.Envelope.To),
+		Cc:          webhookAddresses(msg.Envelope.Cc),
+		Bcc:         webhookAddresses(msg.Envelope.Bcc),
+		Attachments: []webhookAttachment{},
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parse message: %w", err)
+	}
+	err = walkParts(textproto.MIMEHeader(m.Header), m.Body, func(part messagePart) {
+		switch {
+		case isAttachment(part):
+			attachment := webhookAttachment{
+				Filename:    part.Filename,
+				ContentType: part.MediaType,
+				ContentID:   normalizeMessageID(part.Header.Get("Content-ID")),
+				Size:        len(part.Body),
+			}
+			if r.Attachments {
+				attachment.Data = part.Body
+			}
+			doc.Attachments = append(doc.Attachments, attachment)
+		case part.MediaType == "text/plain" && doc.Text == "":
+			doc.Text = partText(part)
+		case part.MediaType == "text/html" && doc.HTML == "":
+			doc.HTML = partText(part)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse message: %w", err)
+	}
+	return doc, nil
+}
+
+func webhookAddresses(addresses []*imap.Address) []webhookAddress {
+	var result []webhookAddress
+	for _, address := range addresses {
+		result = append(result, webhookAddress{Name: address.PersonalName, Address: address.Address()})
+	}
+	return result
+}
+
+func (r *WebhookRule) post(ctx context.Context, url string, doc *webhookMessage) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("construct post request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do http request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *WebhookRule) condition() Predicate {
+	return r.Predicate
+}
+
+func (r *WebhookRule) fetchItems() []imap.FetchItem {
+	items := append([]imap.FetchItem{imap.FetchFlags}, predicateFetchItems(r.Predicate)...)
+	return append(items, templateFetchItems(r.URL)...)
+}
+
+func (r *WebhookRule) String() string {
+	if r.Attachments {
+		return fmt.Sprintf("if %s then webhook json \"%s\" with attachments", r.Predicate, r.URL)
+	}
+	return fmt.Sprintf("if %s then webhook json \"%s\"", r.Predicate, r.URL)
+}